@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"k8s.io/api/admission/v1beta1"
+)
+
+// auditRecord is a single line of the mutation audit log
+type auditRecord struct {
+	Timestamp string          `json:"timestamp"`
+	Namespace string          `json:"namespace"`
+	Name      string          `json:"name"`
+	UID       string          `json:"uid"`
+	User      string          `json:"user"`
+	Patch     json.RawMessage `json:"patch"`
+}
+
+// auditLogger appends one JSON record per applied mutation. Dry runs apply
+// nothing and aren't recorded. A nil *auditLogger discards everything.
+type auditLogger struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// newAuditLogger opens the audit log at path. "-" writes to stdout and an
+// empty path disables the audit log. With maxSizeMB set the file is rotated
+// at that size, keeping maxBackups old files (0 keeps all), gzipped with
+// compress.
+func newAuditLogger(path string, maxSizeMB, maxBackups int, compress bool) (*auditLogger, error) {
+	switch path {
+	case "":
+		return nil, nil
+	case "-":
+		return &auditLogger{out: os.Stdout}, nil
+	}
+	if maxSizeMB > 0 {
+		return &auditLogger{out: &lumberjack.Logger{
+			Filename:   path,
+			MaxSize:    maxSizeMB,
+			MaxBackups: maxBackups,
+			Compress:   compress,
+		}}, nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLogger{out: f}, nil
+}
+
+func (a *auditLogger) log(req *v1beta1.AdmissionRequest, namespace, name string, patch []byte) {
+	if a == nil || (req.DryRun != nil && *req.DryRun) {
+		return
+	}
+	line, err := json.Marshal(auditRecord{
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Namespace: namespace,
+		Name:      name,
+		UID:       string(req.UID),
+		User:      req.UserInfo.Username,
+		Patch:     json.RawMessage(patch),
+	})
+	if err != nil {
+		glog.Errorf("Can't encode audit record: %v", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.out.Write(append(line, '\n')); err != nil {
+		glog.Errorf("Can't write audit record: %v", err)
+	}
+}
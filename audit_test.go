@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+func TestAuditLoggerSkipsDryRun(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name   string
+		dryRun *bool
+		logged bool
+	}{
+		{"not set", nil, true},
+		{"false", &no, true},
+		{"dry run", &yes, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			a := &auditLogger{out: &out}
+			a.log(&v1beta1.AdmissionRequest{UID: "uid", DryRun: tt.dryRun, UserInfo: authenticationv1.UserInfo{Username: "alice"}},
+				"default", "web", []byte(`[]`))
+			if logged := strings.Contains(out.String(), `"user":"alice"`); logged != tt.logged {
+				t.Errorf("logged = %v, want %v: %q", logged, tt.logged, out.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// responseCache keeps the responses to recent requests by UID, so a request
+// the API server retries gets the same answer without being computed again.
+// The least recently used response is evicted once size are cached. A nil
+// *responseCache caches nothing.
+type responseCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	order   *list.List // of *cachedResponse, most recently used first
+	entries map[string]*list.Element
+}
+
+type cachedResponse struct {
+	key      string
+	response v1beta1.AdmissionResponse
+	expires  time.Time
+}
+
+// newResponseCache returns a cache of up to size responses kept for ttl, or
+// nil when size is 0
+func newResponseCache(size int, ttl time.Duration) *responseCache {
+	if size <= 0 {
+		return nil
+	}
+	return &responseCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// responseCacheKey keeps mutate and validate apart, since the API server
+// sends both the same UID
+func responseCacheKey(path string, uid types.UID) string {
+	return path + "|" + string(uid)
+}
+
+// get returns a copy of the cached response for key, if it hasn't expired
+func (c *responseCache) get(key string) (*v1beta1.AdmissionResponse, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	cached := element.Value.(*cachedResponse)
+	if time.Now().After(cached.expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	response := cached.response
+	return &response, true
+}
+
+// put caches a copy of response under key
+func (c *responseCache) put(key string, response *v1beta1.AdmissionResponse) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.order.Remove(element)
+	}
+	c.entries[key] = c.order.PushFront(&cachedResponse{key: key, response: *response, expires: time.Now().Add(c.ttl)})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResponse).key)
+	}
+}
+
+// purge drops every cached response, so none outlives the configuration it
+// was computed with
+func (c *responseCache) purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.entries = map[string]*list.Element{}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// validationRule is a CEL expression that every validated ingress must
+// satisfy, e.g. object.spec.rules.all(r, has(r.host)). The ingress is
+// available as object.
+type validationRule struct {
+	Expression string `json:"expression"`
+	// returned when the expression is false, defaults to the expression
+	Message string `json:"message,omitempty"`
+
+	program cel.Program
+}
+
+var celEnv *cel.Env
+
+func init() {
+	var err error
+	celEnv, err = cel.NewEnv(cel.Declarations(
+		decls.NewVar("object", decls.NewMapType(decls.String, decls.Dyn)),
+	))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// compileValidationRules compiles the expressions of rules in place so that
+// errors show up when the policy is loaded rather than per request
+func compileValidationRules(rules []validationRule) error {
+	var errs []error
+	for i := range rules {
+		rule := &rules[i]
+		ast, issues := celEnv.Compile(rule.Expression)
+		if issues != nil && issues.Err() != nil {
+			errs = append(errs, fmt.Errorf("validation rule %d: %v", i, issues.Err()))
+			continue
+		}
+		if t := ast.ResultType(); !proto.Equal(t, decls.Bool) && !proto.Equal(t, decls.Dyn) {
+			errs = append(errs, fmt.Errorf("validation rule %d: %q does not evaluate to a bool", i, rule.Expression))
+			continue
+		}
+		program, err := celEnv.Program(ast)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("validation rule %d: %v", i, err))
+			continue
+		}
+		rule.program = program
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// checkValidationRules returns the messages of the rules the object doesn't
+// satisfy. A rule that fails to evaluate rejects the object too.
+func checkValidationRules(rules []validationRule, obj runtime.Object) []error {
+	if len(rules) == 0 {
+		return nil
+	}
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return []error{err}
+	}
+	var errs []error
+	for _, rule := range rules {
+		out, _, err := rule.program.Eval(map[string]interface{}{"object": object})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("evaluating %q: %v", rule.Expression, err))
+			continue
+		}
+		if ok, isBool := out.Value().(bool); !isBool || !ok {
+			if rule.Message != "" {
+				errs = append(errs, fmt.Errorf("%s", rule.Message))
+			} else {
+				errs = append(errs, fmt.Errorf("failed %s", rule.Expression))
+			}
+		}
+	}
+	return errs
+}
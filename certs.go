@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// secretCertLoader serves the webhook certificate out of a kubernetes.io/tls
+// Secret and swaps it in place whenever the Secret is rotated.
+type secretCertLoader struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newSecretCertLoader(client kubernetes.Interface, namespace, name string) *secretCertLoader {
+	return &secretCertLoader{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+	}
+}
+
+// load fetches the Secret once so that the server has a certificate before
+// the watch has synced.
+func (l *secretCertLoader) load() error {
+	secret, err := l.client.CoreV1().Secrets(l.namespace).Get(context.TODO(), l.name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	return l.update(secret)
+}
+
+func (l *secretCertLoader) update(secret *corev1.Secret) error {
+	pair, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return fmt.Errorf("secret %s/%s: %v", secret.Namespace, secret.Name, err)
+	}
+	l.mu.Lock()
+	l.cert = &pair
+	l.mu.Unlock()
+	glog.Infof("Loaded serving certificate from secret %s/%s (resourceVersion=%s)", secret.Namespace, secret.Name, secret.ResourceVersion)
+	return nil
+}
+
+func (l *secretCertLoader) onSecret(obj interface{}) {
+	secret, ok := obj.(*corev1.Secret)
+	if !ok {
+		return
+	}
+	if err := l.update(secret); err != nil {
+		// keep serving the previous certificate
+		glog.Errorf("Failed to reload serving certificate: %v", err)
+	}
+}
+
+// watch keeps the certificate current until stopCh is closed.
+func (l *secretCertLoader) watch(stopCh <-chan struct{}) {
+	factory := informers.NewSharedInformerFactoryWithOptions(l.client, 0,
+		informers.WithNamespace(l.namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", l.name).String()
+		}))
+	informer := factory.Core().V1().Secrets().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    l.onSecret,
+		UpdateFunc: func(_, obj interface{}) { l.onSecret(obj) },
+	})
+	factory.Start(stopCh)
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (l *secretCertLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.cert == nil {
+		return nil, fmt.Errorf("no certificate loaded from secret %s/%s", l.namespace, l.name)
+	}
+	return l.cert, nil
+}
+
+// checkServingName returns an error unless the certificate the server would
+// present for name is valid for it, which the API server requires to connect
+func checkServingName(config *tls.Config, name string) error {
+	var cert *tls.Certificate
+	if config.GetCertificate != nil {
+		var err error
+		if cert, err = config.GetCertificate(&tls.ClientHelloInfo{ServerName: name}); err != nil {
+			return err
+		}
+	} else if len(config.Certificates) > 0 {
+		cert = &config.Certificates[0]
+	}
+	if cert == nil || len(cert.Certificate) == 0 {
+		return fmt.Errorf("no serving certificate loaded")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	return leaf.VerifyHostname(name)
+}
+
+// sniCertLoader picks the serving certificate by the server name the client
+// asked for, falling back to the primary certificate for unknown names.
+type sniCertLoader struct {
+	certs   map[string]*tls.Certificate
+	primary func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// newSNICertLoader loads a <hostname>.crt and <hostname>.key pair for every
+// hostname in dir
+func newSNICertLoader(dir string, primary func(*tls.ClientHelloInfo) (*tls.Certificate, error)) (*sniCertLoader, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	l := &sniCertLoader{
+		certs:   map[string]*tls.Certificate{},
+		primary: primary,
+	}
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".crt" {
+			continue
+		}
+		hostname := strings.TrimSuffix(file.Name(), ".crt")
+		pair, err := tls.LoadX509KeyPair(filepath.Join(dir, hostname+".crt"), filepath.Join(dir, hostname+".key"))
+		if err != nil {
+			return nil, fmt.Errorf("certificate for %s: %v", hostname, err)
+		}
+		l.certs[strings.ToLower(hostname)] = &pair
+		glog.Infof("Loaded serving certificate for %s", hostname)
+	}
+	return l, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (l *sniCertLoader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert, ok := l.certs[strings.ToLower(hello.ServerName)]; ok {
+		return cert, nil
+	}
+	return l.primary(hello)
+}
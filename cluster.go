@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	networkinglisters "k8s.io/client-go/listers/networking/v1beta1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ingressLister gives validation access to the ingresses already in the
+// cluster
+type ingressLister interface {
+	// List returns all ingresses, giving up when ctx is done
+	List(ctx context.Context) ([]*networkingv1beta1.Ingress, error)
+	// HasSynced reports whether List reflects the cluster state yet
+	HasSynced() bool
+}
+
+// cachedIngressLister serves ingresses from a shared informer's local cache
+type cachedIngressLister struct {
+	lister networkinglisters.IngressLister
+	synced cache.InformerSynced
+}
+
+// newCachedIngressLister starts an ingress informer for namespace, or all of
+// them with metav1.NamespaceAll, that runs until stopCh is closed
+func newCachedIngressLister(client kubernetes.Interface, namespace string, stopCh <-chan struct{}) *cachedIngressLister {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0, informers.WithNamespace(namespace))
+	ingresses := factory.Networking().V1beta1().Ingresses()
+	l := &cachedIngressLister{
+		lister: ingresses.Lister(),
+		synced: ingresses.Informer().HasSynced,
+	}
+	factory.Start(stopCh)
+	return l
+}
+
+// List reads the cache, which doesn't block; ctx is checked around the read
+// so a caller that has given up gets ctx.Err rather than a late answer
+func (l *cachedIngressLister) List(ctx context.Context) ([]*networkingv1beta1.Ingress, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ingresses, err := l.lister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ingresses, nil
+}
+
+func (l *cachedIngressLister) HasSynced() bool {
+	return l.synced()
+}
+
+// namespaceLister gives mutation access to the labels of namespaces, for
+// entries with a namespaceSelector
+type namespaceLister interface {
+	// Labels returns the labels of the namespace, giving up when ctx is done
+	Labels(ctx context.Context, name string) (map[string]string, error)
+	// HasSynced reports whether Labels reflects the cluster state yet
+	HasSynced() bool
+}
+
+// liveNamespaceLister asks the API server on every call
+type liveNamespaceLister struct {
+	client kubernetes.Interface
+}
+
+func (l *liveNamespaceLister) Labels(ctx context.Context, name string) (map[string]string, error) {
+	namespace, err := l.client.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return namespace.Labels, nil
+}
+
+func (l *liveNamespaceLister) HasSynced() bool {
+	return true
+}
+
+// cachedNamespaceLister serves namespaces from a shared informer's local
+// cache
+type cachedNamespaceLister struct {
+	lister corelisters.NamespaceLister
+	synced cache.InformerSynced
+}
+
+// newCachedNamespaceLister starts a namespace informer that runs until stopCh
+// is closed. With only set it watches just that namespace.
+func newCachedNamespaceLister(client kubernetes.Interface, only string, stopCh <-chan struct{}) *cachedNamespaceLister {
+	var options []informers.SharedInformerOption
+	if only != "" {
+		options = append(options, informers.WithTweakListOptions(func(list *metav1.ListOptions) {
+			list.FieldSelector = fields.OneTermEqualSelector("metadata.name", only).String()
+		}))
+	}
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0, options...)
+	namespaces := factory.Core().V1().Namespaces()
+	l := &cachedNamespaceLister{
+		lister: namespaces.Lister(),
+		synced: namespaces.Informer().HasSynced,
+	}
+	factory.Start(stopCh)
+	return l
+}
+
+func (l *cachedNamespaceLister) Labels(ctx context.Context, name string) (map[string]string, error) {
+	namespace, err := l.lister.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return namespace.Labels, nil
+}
+
+func (l *cachedNamespaceLister) HasSynced() bool {
+	return l.synced()
+}
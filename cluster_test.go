@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	networkinglisters "k8s.io/client-go/listers/networking/v1beta1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestCachedIngressListerContext(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	if err := indexer.Add(testIngress("default", "web", nil)); err != nil {
+		t.Fatal(err)
+	}
+	l := &cachedIngressLister{lister: networkinglisters.NewIngressLister(indexer)}
+
+	ingresses, err := l.List(context.Background())
+	if err != nil || len(ingresses) != 1 {
+		t.Errorf("List = %v, %v, want the cached ingress", ingresses, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if ingresses, err := l.List(ctx); err != context.Canceled {
+		t.Errorf("List with a cancelled context = %v, %v, want %v", ingresses, err, context.Canceled)
+	}
+}
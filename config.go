@@ -0,0 +1,953 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// annotationConfig is a single entry of the default annotations file
+type annotationConfig struct {
+	// name of the object, an ingress or, with Kind Service, a service, or
+	// wildcardIngressName for all of them
+	IngressName string `json:"ingressName"`
+	// regular expression the whole object name must match, instead of
+	// IngressName
+	IngressNameRegex   string         `json:"ingressNameRegex,omitempty"`
+	DefaultAnnotations annotationList `json:"defaultAnnotations"`
+	// URL of a JSON document giving the default annotations in the same
+	// forms as defaultAnnotations. The inline defaultAnnotations, if any, are
+	// used until the document has been fetched once.
+	DefaultAnnotationsURL string `json:"defaultAnnotationsURL,omitempty"`
+	// labels added to the objects the entry applies to, used as is
+	DefaultLabels map[string]string `json:"defaultLabels,omitempty"`
+	// kind of object the entry applies to, kindIngress (default) or
+	// kindService
+	Kind string `json:"kind,omitempty"`
+
+	// restricts the entry to ingresses in this namespace. Empty, or
+	// allNamespaces when a default namespace is given, for all of them.
+	Namespace string `json:"namespace,omitempty"`
+	// restricts the entry to objects in namespaces whose labels match, read
+	// from the cluster
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// entries are merged by ascending priority, so for the same annotation
+	// the value of the higher priority entry is used
+	Priority int `json:"priority,omitempty"`
+
+	// when either is set the entry only applies to requests made by one of
+	// the listed users or by a member of one of the listed groups
+	MatchUsers  []string `json:"matchUsers,omitempty"`
+	MatchGroups []string `json:"matchGroups,omitempty"`
+
+	// when set the entry only applies to objects carrying this annotation,
+	// with the value OptInValue if that is set too
+	OptInAnnotation string `json:"optInAnnotation,omitempty"`
+	OptInValue      string `json:"optInValue,omitempty"`
+	// when set the entry only applies to objects whose annotation matches,
+	// such as one set by GitOps tooling
+	MatchAnnotation *annotationCondition `json:"matchAnnotation,omitempty"`
+
+	// when set the entry only applies to objects with this label, with the
+	// value MatchLabelValue if that is set too
+	MatchLabelKey   string `json:"matchLabelKey,omitempty"`
+	MatchLabelValue string `json:"matchLabelValue,omitempty"`
+
+	// when set the entry only applies to objects with an owner reference of
+	// this kind, with the apiVersion MatchOwnerAPIVersion if that is set too
+	MatchOwnerKind       string `json:"matchOwnerKind,omitempty"`
+	MatchOwnerAPIVersion string `json:"matchOwnerAPIVersion,omitempty"`
+
+	// when set the entry only applies to ingresses with (true) or without
+	// (false) spec.tls
+	HasTLS *bool `json:"hasTLS,omitempty"`
+
+	// when set the entry only applies to ingresses of this class, from
+	// spec.ingressClassName or the legacy kubernetes.io/ingress.class
+	// annotation
+	IngressClass string `json:"ingressClass,omitempty"`
+	// when set the entry only applies to ingresses with neither
+	// spec.ingressClassName nor the legacy class annotation
+	ClassUnset bool `json:"classUnset,omitempty"`
+
+	// when set the entry only applies to ingresses with a rule host in this
+	// domain, e.g. "*.internal.example.com"
+	HostSuffix string `json:"hostSuffix,omitempty"`
+
+	// admission operations the entry applies on, CREATE and/or UPDATE.
+	// Empty means both.
+	Operations []string `json:"operations,omitempty"`
+
+	// how ${HOST} is filled in for ingresses with several hosts, one of
+	// hostModeFirst (default), hostModeAll or hostModePerHost
+	HostMode string `json:"hostMode,omitempty"`
+
+	// false keeps the entry in the file without applying it. Default true.
+	Enabled *bool `json:"enabled,omitempty"`
+	// RFC3339 times the entry applies from and until, each optional
+	ActiveFrom  string `json:"activeFrom,omitempty"`
+	ActiveUntil string `json:"activeUntil,omitempty"`
+
+	// fields whose value had surrounding whitespace removed on load
+	trimmed []string
+	// IngressNameRegex compiled on load
+	nameRegex *regexp.Regexp
+	// MatchAnnotation.ValueRegex compiled on load
+	matchAnnotationRegex *regexp.Regexp
+	// NamespaceSelector converted on load
+	namespaceSelector labels.Selector
+	// ActiveFrom and ActiveUntil parsed on load, zero when not set
+	activeFrom, activeUntil time.Time
+	// conditions of the entry, set up by newAnnotationIndex
+	objectMatchers, requestMatchers []Matcher
+}
+
+// annotationCondition is an annotation an object must carry, with exactly
+// Value or a value matching ValueRegex when either is set
+type annotationCondition struct {
+	Key        string `json:"key"`
+	Value      string `json:"value,omitempty"`
+	ValueRegex string `json:"valueRegex,omitempty"`
+}
+
+// annotationPair is a single default annotation
+type annotationPair struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// annotationList holds the default annotations of an entry in the order they
+// are applied. The config gives them either as a list of key/value pairs,
+// applied in list order, or as an object, applied in key order.
+type annotationList []annotationPair
+
+func (l *annotationList) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	if !bytes.HasPrefix(data, []byte("[")) && !bytes.HasPrefix(data, []byte("{")) {
+		return fmt.Errorf("defaultAnnotations must be an object or a list of key/value pairs, not %s", data)
+	}
+	if bytes.HasPrefix(data, []byte("[")) {
+		var pairs []annotationPair
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&pairs); err != nil {
+			return err
+		}
+		*l = pairs
+		return nil
+	}
+	var values map[string]string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	*l = make(annotationList, 0, len(keys))
+	for _, key := range keys {
+		*l = append(*l, annotationPair{Key: key, Value: values[key]})
+	}
+	return nil
+}
+
+// toMap returns the annotations as a map
+func (l annotationList) toMap() map[string]string {
+	values := make(map[string]string, len(l))
+	for _, pair := range l {
+		values[pair.Key] = pair.Value
+	}
+	return values
+}
+
+const hostPlaceholder = "${HOST}"
+
+// backendsPlaceholder is replaced by the backend services of an ingress,
+// comma separated
+const backendsPlaceholder = "${BACKENDS}"
+
+// ingressName of entries that apply to every object of their kind
+const wildcardIngressName = "*"
+
+// namespace of entries that apply in every namespace even when a default
+// namespace is given
+const allNamespaces = "*"
+
+// kinds of objects the webhook defaults annotations for
+const (
+	kindIngress = "Ingress"
+	kindService = "Service"
+)
+
+const (
+	// ${HOST} is the first host of the ingress rules
+	hostModeFirst = "first"
+	// ${HOST} is all hosts of the ingress rules, comma separated
+	hostModeAll = "all"
+	// the annotation is repeated for every host; its key must contain ${HOST}
+	hostModePerHost = "perHost"
+)
+
+// configError is a problem with a single entry of the config file. Err is
+// one of the Err* types below, or a JSON decoding error.
+type configError struct {
+	Index int
+	// ingressName of the entry, if it has one
+	IngressName string
+	Err         error
+}
+
+func (e *configError) Error() string {
+	if e.IngressName != "" {
+		return fmt.Sprintf("entry %d (ingressName %q): %v", e.Index, e.IngressName, e.Err)
+	}
+	return fmt.Sprintf("entry %d: %v", e.Index, e.Err)
+}
+
+func (e *configError) Unwrap() error {
+	return e.Err
+}
+
+// ErrUnknownField is a field of an entry that the config doesn't know
+type ErrUnknownField struct {
+	Field string
+}
+
+func (e *ErrUnknownField) Error() string {
+	return fmt.Sprintf("unknown field %q", e.Field)
+}
+
+// ErrMissingField is a field that must be set for the entry to be used
+type ErrMissingField struct {
+	Field string
+	// the field the missing one is needed for, if any
+	NeededBy string
+}
+
+func (e *ErrMissingField) Error() string {
+	if e.NeededBy != "" {
+		return fmt.Sprintf("%s needs %s", e.NeededBy, e.Field)
+	}
+	return fmt.Sprintf("%s is required", e.Field)
+}
+
+// ErrInvalidHostMode is a hostMode other than the known ones
+type ErrInvalidHostMode struct {
+	HostMode string
+}
+
+func (e *ErrInvalidHostMode) Error() string {
+	return fmt.Sprintf("unknown hostMode %q", e.HostMode)
+}
+
+// ErrInvalidKind is a kind of object the webhook can't default
+type ErrInvalidKind struct {
+	Kind string
+}
+
+func (e *ErrInvalidKind) Error() string {
+	return fmt.Sprintf("unsupported kind %q, expected %s or %s", e.Kind, kindIngress, kindService)
+}
+
+// ErrInvalidOperation is an operation an entry can't be applied on
+type ErrInvalidOperation struct {
+	Operation string
+}
+
+func (e *ErrInvalidOperation) Error() string {
+	return fmt.Sprintf("unsupported operation %q, expected CREATE or UPDATE", e.Operation)
+}
+
+// ErrInvalidAnnotationValue is a default annotation that can't be applied as
+// written
+type ErrInvalidAnnotationValue struct {
+	Key    string
+	Reason string
+}
+
+func (e *ErrInvalidAnnotationValue) Error() string {
+	return fmt.Sprintf("annotation %s: %s", e.Key, e.Reason)
+}
+
+// ErrInvalidLabel is a default label whose key or value the API server
+// would refuse
+type ErrInvalidLabel struct {
+	Key    string
+	Reason string
+}
+
+func (e *ErrInvalidLabel) Error() string {
+	return fmt.Sprintf("label %s: %s", e.Key, e.Reason)
+}
+
+// ErrInvalidIngressNameRegex is an ingressNameRegex that doesn't compile
+type ErrInvalidIngressNameRegex struct {
+	Pattern string
+	Err     error
+}
+
+func (e *ErrInvalidIngressNameRegex) Error() string {
+	return fmt.Sprintf("invalid ingressNameRegex %q: %v", e.Pattern, e.Err)
+}
+
+// ErrInvalidNamespaceSelector is a namespaceSelector that isn't a valid label
+// selector
+type ErrInvalidNamespaceSelector struct {
+	Err error
+}
+
+func (e *ErrInvalidNamespaceSelector) Error() string {
+	return fmt.Sprintf("invalid namespaceSelector: %v", e.Err)
+}
+
+// ErrInvalidTime is an activeFrom or activeUntil that isn't an RFC3339 time
+type ErrInvalidTime struct {
+	Field string
+	Value string
+}
+
+func (e *ErrInvalidTime) Error() string {
+	return fmt.Sprintf("%s %q is not an RFC3339 time, e.g. 2006-01-02T15:04:05Z", e.Field, e.Value)
+}
+
+// ErrDuplicateIngressName is an entry that matches exactly the same requests
+// as an earlier one
+type ErrDuplicateIngressName struct {
+	IngressName string
+	// index of the earlier entry
+	First int
+}
+
+func (e *ErrDuplicateIngressName) Error() string {
+	return fmt.Sprintf("duplicate of entry %d for ingress %q, merge them into one entry", e.First, e.IngressName)
+}
+
+// decodeError turns the unknown field error of encoding/json, which has no
+// type of its own, into ErrUnknownField
+func decodeError(err error) error {
+	const prefix = "json: unknown field "
+	if msg := err.Error(); strings.HasPrefix(msg, prefix) {
+		return &ErrUnknownField{Field: strings.Trim(strings.TrimPrefix(msg, prefix), `"`)}
+	}
+	return err
+}
+
+// entryErrorsOnly reports whether all of errs concern single entries, so that
+// the rest of the file can still be used
+func entryErrorsOnly(errs []error) bool {
+	for _, err := range errs {
+		if _, ok := err.(*configError); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// loadAnnotationConfig reads and validates the config file. Entries with a
+// problem are dropped; every problem found is returned so that the
+// caller can report all of them at once.
+func loadAnnotationConfig(path, defaultNamespace string) ([]annotationConfig, []error) {
+	byteValue, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, []error{err}
+	}
+	return parseAnnotationConfig(byteValue, defaultNamespace)
+}
+
+// parseAnnotationConfig decodes and validates the entries in data. Entries
+// without a namespace get defaultNamespace, if it is set; allNamespaces
+// keeps an entry global regardless.
+func parseAnnotationConfig(data []byte, defaultNamespace string) ([]annotationConfig, []error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, []error{err}
+	}
+
+	var (
+		entries []annotationConfig
+		errs    []error
+	)
+	seen := map[entryKey]int{}
+	for i, r := range raw {
+		var entry annotationConfig
+		decoder := json.NewDecoder(bytes.NewReader(r))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&entry); err != nil {
+			// name the dropped entry if at least that much can be read
+			var named struct {
+				IngressName string `json:"ingressName"`
+			}
+			json.Unmarshal(r, &named)
+			errs = append(errs, &configError{Index: i, IngressName: named.IngressName, Err: decodeError(err)})
+			continue
+		}
+		entry.trimSpace()
+		// errors from here on are about this entry, which is then left out
+		entryErrs := len(errs)
+		switch entry.Namespace {
+		case "":
+			entry.Namespace = defaultNamespace
+		case allNamespaces:
+			entry.Namespace = ""
+		}
+		switch {
+		case entry.IngressNameRegex != "" && entry.IngressName != "":
+			errs = append(errs, &configError{Index: i, Err: fmt.Errorf("ingressName and ingressNameRegex can't both be set")})
+		case entry.IngressNameRegex != "":
+			// checked on its own so that the error shows the pattern as written
+			if _, err := regexp.Compile(entry.IngressNameRegex); err != nil {
+				errs = append(errs, &configError{Index: i, Err: &ErrInvalidIngressNameRegex{Pattern: entry.IngressNameRegex, Err: err}})
+				break
+			}
+			entry.nameRegex = regexp.MustCompile("^(?:" + entry.IngressNameRegex + ")$")
+		case entry.IngressName == "":
+			errs = append(errs, &configError{Index: i, Err: &ErrMissingField{Field: "ingressName"}})
+		}
+		if entry.NamespaceSelector != nil {
+			selector, err := metav1.LabelSelectorAsSelector(entry.NamespaceSelector)
+			if err != nil {
+				errs = append(errs, &configError{Index: i, Err: &ErrInvalidNamespaceSelector{Err: err}})
+			} else {
+				entry.namespaceSelector = selector
+			}
+		}
+		if len(entry.DefaultAnnotations) == 0 && entry.DefaultAnnotationsURL == "" && len(entry.DefaultLabels) == 0 {
+			errs = append(errs, &configError{Index: i, Err: &ErrMissingField{Field: "defaultAnnotations"}})
+		}
+		if entry.OptInValue != "" && entry.OptInAnnotation == "" {
+			errs = append(errs, &configError{Index: i, Err: &ErrMissingField{Field: "optInAnnotation", NeededBy: "optInValue"}})
+		}
+		if condition := entry.MatchAnnotation; condition != nil {
+			switch {
+			case condition.Key == "":
+				errs = append(errs, &configError{Index: i, Err: &ErrMissingField{Field: "matchAnnotation.key"}})
+			case strings.HasPrefix(condition.Key, admissionWebhookAnnotationPrefix):
+				errs = append(errs, &configError{Index: i, Err: fmt.Errorf("matchAnnotation can't use %s, the webhook's own annotations decide whether it mutates at all", condition.Key)})
+			case condition.Value != "" && condition.ValueRegex != "":
+				errs = append(errs, &configError{Index: i, Err: fmt.Errorf("matchAnnotation value and valueRegex can't both be set")})
+			case condition.ValueRegex != "":
+				if _, err := regexp.Compile(condition.ValueRegex); err != nil {
+					errs = append(errs, &configError{Index: i, Err: fmt.Errorf("invalid matchAnnotation valueRegex %q: %v", condition.ValueRegex, err)})
+					break
+				}
+				entry.matchAnnotationRegex = regexp.MustCompile("^(?:" + condition.ValueRegex + ")$")
+			}
+		}
+		if entry.MatchLabelValue != "" && entry.MatchLabelKey == "" {
+			errs = append(errs, &configError{Index: i, Err: &ErrMissingField{Field: "matchLabelKey", NeededBy: "matchLabelValue"}})
+		}
+		if entry.MatchOwnerAPIVersion != "" && entry.MatchOwnerKind == "" {
+			errs = append(errs, &configError{Index: i, Err: &ErrMissingField{Field: "matchOwnerKind", NeededBy: "matchOwnerAPIVersion"}})
+		}
+		switch entry.Kind {
+		case "", kindIngress, kindService:
+		default:
+			errs = append(errs, &configError{Index: i, Err: &ErrInvalidKind{Kind: entry.Kind}})
+		}
+		if entry.HasTLS != nil && entry.kind() != kindIngress {
+			errs = append(errs, &configError{Index: i, Err: fmt.Errorf("hasTLS only applies to kind %s", kindIngress)})
+		}
+		if entry.IngressClass != "" && entry.kind() != kindIngress {
+			errs = append(errs, &configError{Index: i, Err: fmt.Errorf("ingressClass only applies to kind %s", kindIngress)})
+		}
+		if entry.ClassUnset && entry.kind() != kindIngress {
+			errs = append(errs, &configError{Index: i, Err: fmt.Errorf("classUnset only applies to kind %s", kindIngress)})
+		}
+		if entry.ClassUnset && entry.IngressClass != "" {
+			errs = append(errs, &configError{Index: i, Err: fmt.Errorf("classUnset and ingressClass can't both be set")})
+		}
+		if entry.HostSuffix != "" && entry.kind() != kindIngress {
+			errs = append(errs, &configError{Index: i, Err: fmt.Errorf("hostSuffix only applies to kind %s", kindIngress)})
+		}
+		for _, op := range entry.Operations {
+			if op != "CREATE" && op != "UPDATE" {
+				errs = append(errs, &configError{Index: i, Err: &ErrInvalidOperation{Operation: op}})
+			}
+		}
+		switch entry.HostMode {
+		case "", hostModeFirst, hostModeAll, hostModePerHost:
+		default:
+			errs = append(errs, &configError{Index: i, Err: &ErrInvalidHostMode{HostMode: entry.HostMode}})
+		}
+		for _, field := range []struct {
+			name  string
+			value string
+			time  *time.Time
+		}{
+			{"activeFrom", entry.ActiveFrom, &entry.activeFrom},
+			{"activeUntil", entry.ActiveUntil, &entry.activeUntil},
+		} {
+			if field.value == "" {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, field.value)
+			if err != nil {
+				errs = append(errs, &configError{Index: i, Err: &ErrInvalidTime{Field: field.name, Value: field.value}})
+				continue
+			}
+			*field.time = t
+		}
+		if !entry.activeFrom.IsZero() && !entry.activeUntil.IsZero() && !entry.activeFrom.Before(entry.activeUntil) {
+			errs = append(errs, &configError{Index: i, Err: fmt.Errorf("activeFrom %s is not before activeUntil %s", entry.ActiveFrom, entry.ActiveUntil)})
+		}
+		if entry.DefaultAnnotationsURL != "" {
+			if u, err := url.Parse(entry.DefaultAnnotationsURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				errs = append(errs, &configError{Index: i, Err: fmt.Errorf("defaultAnnotationsURL %q is not an http or https URL", entry.DefaultAnnotationsURL)})
+			}
+		}
+		for _, err := range entry.annotationErrors(entry.DefaultAnnotations) {
+			errs = append(errs, &configError{Index: i, Err: err})
+		}
+		for _, err := range labelErrors(entry.DefaultLabels) {
+			errs = append(errs, &configError{Index: i, Err: err})
+		}
+		// a disabled entry may stage the replacement of an enabled one
+		key := entry.matchKey()
+		if !entry.enabled() {
+			key = entryKey{disabled: i + 1}
+		}
+		if len(errs) == entryErrs {
+			if first, ok := seen[key]; ok {
+				errs = append(errs, &configError{Index: i, Err: &ErrDuplicateIngressName{IngressName: entry.name(), First: first}})
+			} else {
+				seen[key] = i
+			}
+		}
+		if len(errs) > entryErrs {
+			// a half valid entry could match far more than it says, e.g.
+			// every name when its ingressNameRegex doesn't compile
+			for _, err := range errs[entryErrs:] {
+				err.(*configError).IngressName = entry.IngressName
+			}
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, errs
+}
+
+// trimSpace removes the whitespace around the names an entry is matched by,
+// which never match an object name and are most likely a formatting mistake
+func (c *annotationConfig) trimSpace() {
+	for _, field := range []struct {
+		name  string
+		value *string
+	}{
+		{"ingressName", &c.IngressName},
+		{"namespace", &c.Namespace},
+	} {
+		if trimmed := strings.TrimSpace(*field.value); trimmed != *field.value {
+			*field.value = trimmed
+			c.trimmed = append(c.trimmed, field.name)
+		}
+	}
+}
+
+// annotationErrors checks default annotations given for the entry
+func (c *annotationConfig) annotationErrors(annotations annotationList) []error {
+	var errs []error
+	keys := map[string]bool{}
+	for _, pair := range annotations {
+		ann, val := pair.Key, pair.Value
+		if ann == "" {
+			errs = append(errs, &ErrInvalidAnnotationValue{Key: ann, Reason: "empty key"})
+		}
+		if keys[ann] {
+			errs = append(errs, &ErrInvalidAnnotationValue{Key: ann, Reason: "set more than once"})
+		}
+		keys[ann] = true
+		keyHasHost := strings.Contains(ann, hostPlaceholder)
+		if c.HostMode == hostModePerHost && strings.Contains(val, hostPlaceholder) && !keyHasHost {
+			errs = append(errs, &ErrInvalidAnnotationValue{Key: ann, Reason: fmt.Sprintf("hostMode %s needs %s in the key", hostModePerHost, hostPlaceholder)})
+		}
+		if c.HostMode != hostModePerHost && keyHasHost {
+			errs = append(errs, &ErrInvalidAnnotationValue{Key: ann, Reason: fmt.Sprintf("%s in a key needs hostMode %s", hostPlaceholder, hostModePerHost)})
+		}
+		if namespaceLabelReference.MatchString(ann) {
+			errs = append(errs, &ErrInvalidAnnotationValue{Key: ann, Reason: "${NAMESPACE_LABEL:key} can only be used in values"})
+		}
+		if strings.Contains(ann, backendsPlaceholder) {
+			errs = append(errs, &ErrInvalidAnnotationValue{Key: ann, Reason: fmt.Sprintf("%s can only be used in values", backendsPlaceholder)})
+		}
+	}
+	return errs
+}
+
+// labelErrors checks default labels against the syntax the API server
+// enforces, so a bad one fails the load instead of every mutation
+func labelErrors(labels map[string]string) []error {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var errs []error
+	for _, key := range keys {
+		if msgs := validation.IsQualifiedName(key); len(msgs) > 0 {
+			errs = append(errs, &ErrInvalidLabel{Key: key, Reason: strings.Join(msgs, "; ")})
+		}
+		if msgs := validation.IsValidLabelValue(labels[key]); len(msgs) > 0 {
+			errs = append(errs, &ErrInvalidLabel{Key: key, Reason: fmt.Sprintf("value %q: %s", labels[key], strings.Join(msgs, "; "))})
+		}
+	}
+	return errs
+}
+
+// annotationIndex holds the config entries by kind and lowercased name, in
+// file order, so a request only looks at the entries for its own object
+type annotationIndex map[string][]*annotationConfig
+
+func newAnnotationIndex(entries []annotationConfig) annotationIndex {
+	index := annotationIndex{}
+	for i := range entries {
+		if !entries[i].enabled() {
+			continue
+		}
+		entries[i].objectMatchers, entries[i].requestMatchers = entries[i].matchers()
+		key := indexKey(entries[i].kind(), entries[i].IngressName)
+		if entries[i].IngressNameRegex != "" {
+			key = regexIndexKey(entries[i].kind())
+		}
+		index[key] = append(index[key], &entries[i])
+	}
+	return index
+}
+
+func indexKey(kind, name string) string {
+	return kind + "/" + strings.ToLower(name)
+}
+
+// regexIndexKey holds the entries matching names by ingressNameRegex, which
+// have to be checked against every object of the kind. "~" is not allowed in
+// object names.
+func regexIndexKey(kind string) string {
+	return kind + "/~regex"
+}
+
+// needsNamespaceLabels reports whether any entry needs the labels of the
+// namespace of the objects it is applied to, for its namespaceSelector or a
+// ${NAMESPACE_LABEL:key} value
+func needsNamespaceLabels(index annotationIndex) bool {
+	for _, entries := range index {
+		for _, entry := range entries {
+			if entry.namespaceSelector != nil {
+				return true
+			}
+			for _, pair := range entry.DefaultAnnotations {
+				if namespaceLabelReference.MatchString(pair.Value) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// namesExactly reports whether an entry naming an object uses the case of
+// name. Catch-all and regex entries always do.
+func (c *annotationConfig) namesExactly(name string) bool {
+	return c.IngressNameRegex != "" || c.IngressName == wildcardIngressName || c.IngressName == name
+}
+
+// name returns what the entry matches object names by
+func (c *annotationConfig) name() string {
+	if c.IngressNameRegex != "" {
+		return "regex:" + c.IngressNameRegex
+	}
+	return c.IngressName
+}
+
+// nameRank orders entries for merging by how specific their name is:
+// catch-all entries first, then regular expressions, then exact names
+func (c *annotationConfig) nameRank() int {
+	switch {
+	case c.IngressName == wildcardIngressName:
+		return 0
+	case c.IngressNameRegex != "":
+		return 1
+	}
+	return 2
+}
+
+// enabled reports whether the entry is applied
+func (c *annotationConfig) enabled() bool {
+	return c.Enabled == nil || *c.Enabled
+}
+
+// kind returns the kind of object the entry applies to
+func (c *annotationConfig) kind() string {
+	if c.Kind == "" {
+		return kindIngress
+	}
+	return c.Kind
+}
+
+// describe names the entry in logs and audit annotations
+func (c *annotationConfig) describe() string {
+	if c.Namespace != "" {
+		return c.Namespace + "/" + c.name()
+	}
+	return c.name()
+}
+
+// entryKey identifies the requests an entry applies to and where it is
+// merged. Two entries with the same key are duplicates whose order would
+// silently decide conflicting values.
+type entryKey struct {
+	kind, ingressName, ingressNameRegex  string
+	namespace, namespaceSelector         string
+	priority                             int
+	users, groups, operations            string
+	optInAnnotation, optInValue          string
+	hasMatchAnnotation                   bool
+	matchAnnotation                      annotationCondition
+	matchLabelKey, matchLabelValue       string
+	matchOwnerKind, matchOwnerAPIVersion string
+	hasTLS                               string
+	ingressClass                         string
+	classUnset                           bool
+	hostSuffix, activeFrom, activeUntil  string
+	// index of a disabled entry, which is never a duplicate
+	disabled int
+}
+
+// matchKey returns the entryKey of the entry
+func (c *annotationConfig) matchKey() entryKey {
+	key := entryKey{
+		kind:                 c.kind(),
+		ingressName:          strings.ToLower(c.IngressName),
+		ingressNameRegex:     c.IngressNameRegex,
+		namespace:            c.Namespace,
+		priority:             c.Priority,
+		users:                sortedList(c.MatchUsers),
+		groups:               sortedList(c.MatchGroups),
+		operations:           sortedList(c.Operations),
+		optInAnnotation:      c.OptInAnnotation,
+		optInValue:           c.OptInValue,
+		matchLabelKey:        c.MatchLabelKey,
+		matchLabelValue:      c.MatchLabelValue,
+		matchOwnerKind:       c.MatchOwnerKind,
+		matchOwnerAPIVersion: c.MatchOwnerAPIVersion,
+		hasTLS:               "any",
+		ingressClass:         c.IngressClass,
+		classUnset:           c.ClassUnset,
+		hostSuffix:           strings.ToLower(c.HostSuffix),
+		activeFrom:           c.ActiveFrom,
+		activeUntil:          c.ActiveUntil,
+	}
+	if c.namespaceSelector != nil {
+		key.namespaceSelector = c.namespaceSelector.String()
+	}
+	if c.MatchAnnotation != nil {
+		key.hasMatchAnnotation = true
+		key.matchAnnotation = *c.MatchAnnotation
+	}
+	if c.HasTLS != nil {
+		key.hasTLS = fmt.Sprint(*c.HasTLS)
+	}
+	return key
+}
+
+// sortedList quotes the sorted values, so that no two lists give the same
+// string
+func sortedList(values []string) string {
+	sorted := append([]string(nil), values...)
+	sort.Strings(sorted)
+	return fmt.Sprintf("%q", sorted)
+}
+
+// configWarnings returns the problems with entries that don't stop them from
+// loading but likely keep them from ever matching
+func configWarnings(entries []annotationConfig) []string {
+	var warnings []string
+	for _, entry := range entries {
+		for _, field := range entry.trimmed {
+			warnings = append(warnings, fmt.Sprintf("%s of %s has surrounding whitespace, which was ignored", field, entry.describe()))
+		}
+		if !entry.activeUntil.IsZero() && entry.activeUntil.Before(time.Now()) {
+			warnings = append(warnings, fmt.Sprintf("%s expired at %s and no longer applies", entry.describe(), entry.ActiveUntil))
+		}
+		if entry.IngressName == "" || entry.IngressName == wildcardIngressName {
+			continue
+		}
+		msgs := validation.IsDNS1123Subdomain(entry.IngressName)
+		if len(msgs) == 0 {
+			continue
+		}
+		warning := fmt.Sprintf("ingressName %q is not a valid object name: %s", entry.IngressName, strings.Join(msgs, "; "))
+		if strings.Contains(entry.IngressName, "/") {
+			warning += "; to select a namespace use the namespace field"
+		}
+		warnings = append(warnings, warning)
+	}
+	return warnings
+}
+
+// validateConfigFile checks a config file without starting the server,
+// printing each problem found. It returns the process exit code.
+func validateConfigFile(path, defaultNamespace string) int {
+	entries, errs := loadAnnotationConfig(path, defaultNamespace)
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+	}
+	for _, warning := range configWarnings(entries) {
+		fmt.Fprintf(os.Stderr, "%s: warning: %s\n", path, warning)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	fmt.Printf("%s: %d entries OK\n", path, len(entries))
+	return 0
+}
+
+// printEffectiveConfig writes the flags and the loaded configuration to w as
+// JSON. ${ENV:NAME} references in the annotation values are expanded as they
+// would be for a request.
+func printEffectiveConfig(w io.Writer, entries []annotationConfig, policy policyConfig) error {
+	flags := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+	expanded := make([]annotationConfig, len(entries))
+	for i, entry := range entries {
+		annotations := make(annotationList, 0, len(entry.DefaultAnnotations))
+		for _, pair := range entry.DefaultAnnotations {
+			value, _ := expandEnv(pair.Value, false)
+			annotations = append(annotations, annotationPair{Key: pair.Key, Value: value})
+		}
+		entry.DefaultAnnotations = annotations
+		expanded[i] = entry
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "    ")
+	return encoder.Encode(map[string]interface{}{
+		"flags":              flags,
+		"defaultAnnotations": expanded,
+		"policy":             policy,
+	})
+}
+
+// policyConfig holds the settings that can also be given in the optional
+// policy file. Fields set in the file replace the value from the flags.
+type policyConfig struct {
+	// namespaces whose objects aren't mutated and ones whose ingresses
+	// aren't validated
+	NoMutateNamespaces   []string `json:"noMutateNamespaces,omitempty"`
+	NoValidateNamespaces []string `json:"noValidateNamespaces,omitempty"`
+	// sets both lists at once, for policy files written before they were
+	// split; only read from the file
+	IgnoredNamespaces    []string `json:"ignoredNamespaces,omitempty"`
+	ForbiddenAnnotations []string `json:"forbiddenAnnotations,omitempty"`
+	AllowedAnnotations   []string `json:"allowedAnnotations,omitempty"`
+	// CEL expressions ingresses must satisfy, only from the policy file
+	ValidationRules []validationRule `json:"validationRules,omitempty"`
+	// annotations ingresses must carry, only from the policy file
+	RequiredAnnotations []requiredAnnotation `json:"requiredAnnotations,omitempty"`
+	// reject every ingress change except those of LockdownAllowedUsers
+	Lockdown             bool     `json:"lockdown,omitempty"`
+	LockdownAllowedUsers []string `json:"lockdownAllowedUsers,omitempty"`
+	// allow every request untouched, only from the policy file
+	Paused bool `json:"paused,omitempty"`
+}
+
+// loadPolicyConfig overlays the policy file at path on base. An empty path
+// returns base unchanged.
+func loadPolicyConfig(base policyConfig, path string) (policyConfig, error) {
+	if path == "" {
+		return base, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return base, err
+	}
+	var file policyConfig
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return base, fmt.Errorf("%s: %v", path, err)
+	}
+	policy := base
+	if file.IgnoredNamespaces != nil {
+		policy.NoMutateNamespaces = file.IgnoredNamespaces
+		policy.NoValidateNamespaces = file.IgnoredNamespaces
+	}
+	if file.NoMutateNamespaces != nil {
+		policy.NoMutateNamespaces = file.NoMutateNamespaces
+	}
+	if file.NoValidateNamespaces != nil {
+		policy.NoValidateNamespaces = file.NoValidateNamespaces
+	}
+	if file.ForbiddenAnnotations != nil {
+		policy.ForbiddenAnnotations = file.ForbiddenAnnotations
+	}
+	if file.AllowedAnnotations != nil {
+		policy.AllowedAnnotations = file.AllowedAnnotations
+	}
+	if file.Lockdown {
+		policy.Lockdown = true
+	}
+	if file.LockdownAllowedUsers != nil {
+		policy.LockdownAllowedUsers = file.LockdownAllowedUsers
+	}
+	if err := compileValidationRules(file.ValidationRules); err != nil {
+		return base, fmt.Errorf("%s: %v", path, err)
+	}
+	policy.ValidationRules = file.ValidationRules
+	if err := compileRequiredAnnotations(file.RequiredAnnotations); err != nil {
+		return base, fmt.Errorf("%s: %v", path, err)
+	}
+	policy.RequiredAnnotations = file.RequiredAnnotations
+	policy.Paused = file.Paused
+	return policy, nil
+}
+
+// requiredAnnotation is an annotation every validated ingress must have,
+// with a value matching Pattern if that is set
+type requiredAnnotation struct {
+	Key string `json:"key"`
+	// regular expression the value has to match, e.g. ^CC-[0-9]{4}$
+	Pattern string `json:"pattern,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// compileRequiredAnnotations compiles the patterns of required in place so
+// that errors show up when the policy is loaded rather than per request
+func compileRequiredAnnotations(required []requiredAnnotation) error {
+	var errs []error
+	for i := range required {
+		annotation := &required[i]
+		if annotation.Key == "" {
+			errs = append(errs, fmt.Errorf("required annotation %d: key is required", i))
+			continue
+		}
+		if annotation.Pattern == "" {
+			continue
+		}
+		pattern, err := regexp.Compile(annotation.Pattern)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("required annotation %s: %v", annotation.Key, err))
+			continue
+		}
+		annotation.pattern = pattern
+	}
+	return utilerrors.NewAggregate(errs)
+}
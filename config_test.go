@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseAnnotationConfigDropsInvalidEntries(t *testing.T) {
+	const valid = `{"ingressName": "ok", "defaultAnnotations": {"a": "1"}}`
+	tests := []struct {
+		name  string
+		entry string
+	}{
+		{"annotations not a map", `{"ingressName": "x", "defaultAnnotations": "a=1"}`},
+		{"unknown field", `{"ingressName": "x", "defaultAnnotation": {"a": "1"}}`},
+		{"bad ingressNameRegex", `{"ingressNameRegex": "prod-(", "defaultAnnotations": {"a": "1"}}`},
+		{"name and regex", `{"ingressName": "x", "ingressNameRegex": "x.*", "defaultAnnotations": {"a": "1"}}`},
+		{"bad namespaceSelector", `{"ingressName": "x", "namespaceSelector": {"matchExpressions": [{"key": "team", "operator": "Bogus"}]}, "defaultAnnotations": {"a": "1"}}`},
+		{"bad activeFrom", `{"ingressName": "x", "activeFrom": "tomorrow", "defaultAnnotations": {"a": "1"}}`},
+		{"activeUntil before activeFrom", `{"ingressName": "x", "activeFrom": "2030-01-02T00:00:00Z", "activeUntil": "2030-01-01T00:00:00Z", "defaultAnnotations": {"a": "1"}}`},
+		{"matchAnnotation on the webhook's own key", `{"ingressName": "x", "matchAnnotation": {"key": "admission-webhook-example.citrix.com/status"}, "defaultAnnotations": {"a": "1"}}`},
+		{"matchAnnotation without key", `{"ingressName": "x", "matchAnnotation": {"value": "v"}, "defaultAnnotations": {"a": "1"}}`},
+		{"bad matchAnnotation valueRegex", `{"ingressName": "x", "matchAnnotation": {"key": "k", "valueRegex": "("}, "defaultAnnotations": {"a": "1"}}`},
+		{"invalid label value", `{"ingressName": "x", "defaultLabels": {"team": "team a"}}`},
+		{"invalid label key", `{"ingressName": "x", "defaultLabels": {"a/b/c": "1"}}`},
+		{"duplicate", valid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, errs := parseAnnotationConfig([]byte("["+valid+","+tt.entry+"]"), "")
+			if len(errs) == 0 {
+				t.Fatal("no error")
+			}
+			for _, err := range errs {
+				ce, ok := err.(*configError)
+				if !ok || ce.Index != 1 {
+					t.Errorf("error %v is not about entry 1", err)
+				}
+			}
+			if len(entries) != 1 || entries[0].IngressName != "ok" {
+				t.Errorf("entries = %+v, want only the valid one", entries)
+			}
+		})
+	}
+}
+
+func TestParseAnnotationConfigNamesDroppedEntries(t *testing.T) {
+	_, errs := parseAnnotationConfig([]byte(`[{"ingressName": "web", "activeFrom": "tomorrow", "defaultAnnotations": {"a": "1"}}]`), "")
+	if len(errs) != 1 || errs[0].(*configError).IngressName != "web" {
+		t.Fatalf("errors = %v, want one naming web", errs)
+	}
+}
+
+// TestParseAnnotationConfigDistinctEntries checks that entries differing in a
+// single condition aren't taken for duplicates
+func TestParseAnnotationConfigDistinctEntries(t *testing.T) {
+	tests := []struct {
+		name          string
+		first, second string
+	}{
+		{"user lists", `"matchUsers": ["alice,bob"]`, `"matchUsers": ["alice", "bob"]`},
+		{"label key and value", `"matchLabelKey": "team", "matchLabelValue": "a|b"`, `"matchLabelKey": "team|a", "matchLabelValue": "b"`},
+		{"matchAnnotation", `"matchAnnotation": {"key": "k", "value": "v"}`, `"matchAnnotation": {"key": "k", "valueRegex": "v"}`},
+		{"hasTLS", `"hasTLS": false`, `"hasTLS": true`},
+		{"disabled", `"enabled": false`, `"enabled": false`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := `[{"ingressName": "x", ` + tt.first + `, "defaultAnnotations": {"a": "1"}},
+				{"ingressName": "x", ` + tt.second + `, "defaultAnnotations": {"a": "2"}}]`
+			if entries, errs := parseAnnotationConfig([]byte(config), ""); len(errs) > 0 || len(entries) != 2 {
+				t.Errorf("entries %+v, errors %v, want both entries", entries, errs)
+			}
+		})
+	}
+}
+
+func TestParseAnnotationConfigErrorTypes(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   error
+	}{
+		{"unknown field", `[{"ingressName": "x", "defaultAnnotaions": {"a": "1"}}]`,
+			&ErrUnknownField{Field: "defaultAnnotaions"}},
+		{"no ingressName", `[{"defaultAnnotations": {"a": "1"}}]`,
+			&ErrMissingField{Field: "ingressName"}},
+		{"no defaults", `[{"ingressName": "x"}]`,
+			&ErrMissingField{Field: "defaultAnnotations"}},
+		{"optInValue alone", `[{"ingressName": "x", "optInValue": "yes", "defaultAnnotations": {"a": "1"}}]`,
+			&ErrMissingField{Field: "optInAnnotation", NeededBy: "optInValue"}},
+		{"hostMode", `[{"ingressName": "x", "hostMode": "some", "defaultAnnotations": {"a": "1"}}]`,
+			&ErrInvalidHostMode{HostMode: "some"}},
+		{"kind", `[{"ingressName": "x", "kind": "Pod", "defaultAnnotations": {"a": "1"}}]`,
+			&ErrInvalidKind{Kind: "Pod"}},
+		{"operation", `[{"ingressName": "x", "operations": ["DELETE"], "defaultAnnotations": {"a": "1"}}]`,
+			&ErrInvalidOperation{Operation: "DELETE"}},
+		{"empty annotation key", `[{"ingressName": "x", "defaultAnnotations": {"": "1"}}]`,
+			&ErrInvalidAnnotationValue{Key: "", Reason: "empty key"}},
+		{"label", `[{"ingressName": "x", "defaultLabels": {"team": "team a"}}]`,
+			&ErrInvalidLabel{}},
+		{"ingressNameRegex", `[{"ingressNameRegex": "prod-(", "defaultAnnotations": {"a": "1"}}]`,
+			&ErrInvalidIngressNameRegex{}},
+		{"namespaceSelector", `[{"ingressName": "x", "namespaceSelector": {"matchExpressions": [{"key": "team", "operator": "Bogus"}]}, "defaultAnnotations": {"a": "1"}}]`,
+			&ErrInvalidNamespaceSelector{}},
+		{"time", `[{"ingressName": "x", "activeUntil": "soon", "defaultAnnotations": {"a": "1"}}]`,
+			&ErrInvalidTime{Field: "activeUntil", Value: "soon"}},
+		{"duplicate", `[{"ingressName": "x", "defaultAnnotations": {"a": "1"}}, {"ingressName": "x", "defaultAnnotations": {"b": "1"}}]`,
+			&ErrDuplicateIngressName{IngressName: "x", First: 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, errs := parseAnnotationConfig([]byte(tt.config), "")
+			if len(errs) != 1 {
+				t.Fatalf("errors = %v, want one", errs)
+			}
+			var ce *configError
+			if !errors.As(errs[0], &ce) {
+				t.Fatalf("%v is a %T, want a *configError", errs[0], errs[0])
+			}
+			if reflect.TypeOf(ce.Err) != reflect.TypeOf(tt.want) {
+				t.Fatalf("%v is a %T, want a %T", ce.Err, ce.Err, tt.want)
+			}
+			// errors with a cause or a generated reason are only checked by type
+			switch tt.want.(type) {
+			case *ErrInvalidLabel, *ErrInvalidIngressNameRegex, *ErrInvalidNamespaceSelector:
+			default:
+				if !reflect.DeepEqual(ce.Err, tt.want) {
+					t.Errorf("error = %#v, want %#v", ce.Err, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestAnnotationListOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want annotationList
+	}{
+		{"list keeps its order", `[{"key": "z", "value": "1"}, {"key": "a", "value": "2"}, {"key": "m", "value": "3"}]`,
+			annotationList{{Key: "z", Value: "1"}, {Key: "a", Value: "2"}, {Key: "m", Value: "3"}}},
+		{"map is sorted by key", `{"z": "1", "a": "2", "m": "3"}`,
+			annotationList{{Key: "a", Value: "2"}, {Key: "m", Value: "3"}, {Key: "z", Value: "1"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got annotationList
+			if err := got.UnmarshalJSON([]byte(tt.json)); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnnotationListErrors(t *testing.T) {
+	for _, config := range []string{
+		`[{"ingressName": "x", "defaultAnnotations": [{"key": "a", "value": "1"}, {"key": "a", "value": "2"}]}]`,
+		`[{"ingressName": "x", "defaultAnnotations": [{"key": "a", "val": "1"}]}]`,
+		`[{"ingressName": "x", "defaultAnnotations": "a=1"}]`,
+	} {
+		if entries, errs := parseAnnotationConfig([]byte(config), ""); len(errs) != 1 || len(entries) != 0 {
+			t.Errorf("%s: entries %v, errors %v, want the entry dropped for one error", config, entries, errs)
+		}
+	}
+}
+
+func TestParseAnnotationConfigDefaultNamespace(t *testing.T) {
+	entries, errs := parseAnnotationConfig([]byte(`[
+		{"ingressName": "defaulted", "defaultAnnotations": {"a": "1"}},
+		{"ingressName": "explicit", "namespace": "team-b", "defaultAnnotations": {"a": "1"}},
+		{"ingressName": "everywhere", "namespace": "*", "defaultAnnotations": {"a": "1"}}
+	]`), "team-a")
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	want := map[string]string{"defaulted": "team-a", "explicit": "team-b", "everywhere": ""}
+	if len(entries) != len(want) {
+		t.Fatalf("entries = %+v", entries)
+	}
+	for _, entry := range entries {
+		if entry.Namespace != want[entry.IngressName] {
+			t.Errorf("%s has namespace %q, want %q", entry.IngressName, entry.Namespace, want[entry.IngressName])
+		}
+	}
+
+	// without a default an entry without namespace applies everywhere
+	entries, errs = parseAnnotationConfig([]byte(`[{"ingressName": "x", "defaultAnnotations": {"a": "1"}}]`), "")
+	if len(errs) > 0 || entries[0].Namespace != "" {
+		t.Errorf("entries = %+v, errors %v, want no namespace", entries, errs)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// requireClientCert only passes on requests that present a client
+// certificate signed by one of roots. The certificate is requested but not
+// required during the handshake so that the API server's calls to the
+// webhook endpoints are unaffected.
+func requireClientCert(roots *x509.CertPool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range r.TLS.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		if _, err := r.TLS.PeerCertificates[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}); err != nil {
+			glog.Warningf("Rejecting %s from %s: %v", r.URL.Path, r.RemoteAddr, err)
+			http.Error(w, "client certificate not trusted", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// loadCertPool reads a PEM bundle of CA certificates
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s contains no PEM certificates", path)
+	}
+	return pool, nil
+}
+
+// debugMatch answers /debug/match?entry=<ingressName> with the existing
+// ingresses of that name, or all of them for wildcardIngressName, and the
+// config entries each one gets in the order they are merged. Conditions on
+// the requesting user and the operation depend on the request and are not
+// evaluated.
+func (whsvr *WebhookServer) debugMatch(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("entry")
+	if name == "" {
+		http.Error(w, "missing entry parameter", http.StatusBadRequest)
+		return
+	}
+	if whsvr.ingressLister == nil {
+		http.Error(w, "no kubernetes client", http.StatusServiceUnavailable)
+		return
+	}
+	index := whsvr.annotationConfigIndex()
+	ingresses, err := whsvr.ingressLister.List(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not list ingresses: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	matches := map[string][]string{}
+	entries := map[*annotationConfig]bool{}
+	for _, ingress := range ingresses {
+		if name != wildcardIngressName && !strings.EqualFold(ingress.Name, name) {
+			continue
+		}
+		obj := &admissionObject{
+			kind:         kindIngress,
+			metadata:     &ingress.ObjectMeta,
+			hosts:        ingressHosts(ingress),
+			hasTLS:       len(ingress.Spec.TLS) > 0,
+			ingressClass: effectiveIngressClass(ingress),
+		}
+		if needsNamespaceLabels(index) {
+			obj.namespaceLabels = whsvr.namespaceLabels(r.Context(), ingress.Namespace)
+		}
+		for _, dflt := range objectEntries(index, obj, whsvr.caseSensitiveMatch) {
+			key := ingress.Namespace + "/" + ingress.Name
+			matches[key] = append(matches[key], dflt.describe())
+			entries[dflt] = true
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"entry":   name,
+		"entries": len(entries),
+		"matches": matches,
+	}); err != nil {
+		glog.Errorf("Can't write response: %v", err)
+	}
+}
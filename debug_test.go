@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+)
+
+func TestDebugMatch(t *testing.T) {
+	whsvr := newTestServer(t, `[
+		{"ingressName": "*", "defaultAnnotations": {"a": "1"}},
+		{"ingressName": "*", "namespaceSelector": {"matchLabels": {"tier": "gold"}}, "defaultAnnotations": {"sla": "gold"}},
+		{"ingressNameRegex": "web-.*", "defaultAnnotations": {"b": "1"}},
+		{"ingressName": "web-1", "defaultAnnotations": {"c": "1"}},
+		{"ingressName": "web-1", "namespace": "team-b", "matchUsers": ["alice"], "defaultAnnotations": {"d": "1"}}
+	]`)
+	whsvr.ingressLister = &fakeIngressLister{ingresses: []*networkingv1beta1.Ingress{
+		testIngress("team-a", "web-1", nil),
+		testIngress("team-b", "web-1", nil),
+		testIngress("team-a", "api", nil),
+	}}
+	whsvr.namespaceLister = &fakeNamespaceLister{labels: map[string]map[string]string{"team-a": {"tier": "gold"}}}
+
+	tests := []struct {
+		entry   string
+		entries int
+		matches map[string][]string
+	}{
+		{"web-1", 5, map[string][]string{
+			"team-a/web-1": {"*", "*", "regex:web-.*", "web-1"},
+			"team-b/web-1": {"*", "regex:web-.*", "web-1", "team-b/web-1"},
+		}},
+		{"*", 5, map[string][]string{
+			"team-a/web-1": {"*", "*", "regex:web-.*", "web-1"},
+			"team-b/web-1": {"*", "regex:web-.*", "web-1", "team-b/web-1"},
+			"team-a/api":   {"*", "*"},
+		}},
+		{"missing", 0, map[string][]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			whsvr.debugMatch(w, httptest.NewRequest("GET", "/debug/match?entry="+tt.entry, nil))
+			var got struct {
+				Entries int
+				Matches map[string][]string
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("%s: %v", w.Body, err)
+			}
+			if got.Entries != tt.entries || !reflect.DeepEqual(got.Matches, tt.matches) {
+				t.Errorf("got %+v, want %d entries and matches %v", got, tt.entries, tt.matches)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	dumpRequestSuffix  = ".request.json"
+	dumpResponseSuffix = ".response.json"
+	// sorts in the order the dumps were written
+	dumpTimeFormat = "20060102T150405.000000000Z"
+)
+
+// requestDumper writes the body of every admission request and the review
+// answering it to a pair of files in dir, to replay them offline. The oldest
+// pairs are removed once there are more than maxFiles or they take more than
+// maxBytes, but the newest is always kept. A nil *requestDumper writes nothing.
+type requestDumper struct {
+	dir      string
+	maxFiles int   // 0 for no limit
+	maxBytes int64 // 0 for no limit
+
+	mu sync.Mutex
+}
+
+// newRequestDumper dumps to dir, creating it if needed. An empty dir
+// disables dumping.
+func newRequestDumper(dir string, maxFiles, maxSizeMB int) (*requestDumper, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &requestDumper{dir: dir, maxFiles: maxFiles, maxBytes: int64(maxSizeMB) << 20}, nil
+}
+
+// dumpName is the common prefix of the files of a request to webhook with
+// uid, made safe for a file name
+func dumpName(now time.Time, webhook string, uid types.UID) string {
+	id := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, string(uid))
+	if id == "" {
+		id = "nouid"
+	}
+	return now.UTC().Format(dumpTimeFormat) + "-" + id + "-" + webhook
+}
+
+// dump writes body, as the API server sent it, and review, the answer to
+// req. req is nil when body didn't decode.
+func (d *requestDumper) dump(webhook string, req *v1beta1.AdmissionRequest, body []byte, review *v1beta1.AdmissionReview) {
+	var uid types.UID
+	if req != nil {
+		uid = req.UID
+	}
+	if d == nil || uid == selfTestUID {
+		return
+	}
+	response, err := json.Marshal(review)
+	if err != nil {
+		glog.Errorf("Can't encode the response to %s for the dump: %v", uid, err)
+		return
+	}
+	name := filepath.Join(d.dir, dumpName(time.Now(), webhook, uid))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := ioutil.WriteFile(name+dumpRequestSuffix, body, 0600); err != nil {
+		glog.Errorf("Can't dump request %s: %v", uid, err)
+		return
+	}
+	if err := ioutil.WriteFile(name+dumpResponseSuffix, response, 0600); err != nil {
+		glog.Errorf("Can't dump the response to %s: %v", uid, err)
+	}
+	d.cleanup()
+}
+
+// cleanup removes the oldest dumps beyond maxFiles and maxBytes
+func (d *requestDumper) cleanup() {
+	if d.maxFiles <= 0 && d.maxBytes <= 0 {
+		return
+	}
+	files, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		glog.Errorf("Can't list the dumps in %s: %v", d.dir, err)
+		return
+	}
+	// files are sorted by name, so the pairs of a dump are adjacent and the
+	// oldest dumps come first
+	var names []string
+	sizes := map[string]int64{}
+	var total int64
+	for _, file := range files {
+		name := strings.TrimSuffix(strings.TrimSuffix(file.Name(), dumpRequestSuffix), dumpResponseSuffix)
+		if file.IsDir() || name == file.Name() {
+			continue
+		}
+		if _, ok := sizes[name]; !ok {
+			names = append(names, name)
+		}
+		sizes[name] += file.Size()
+		total += file.Size()
+	}
+	for len(names) > 1 && ((d.maxFiles > 0 && len(names) > d.maxFiles) || (d.maxBytes > 0 && total > d.maxBytes)) {
+		for _, suffix := range []string{dumpRequestSuffix, dumpResponseSuffix} {
+			if err := os.Remove(filepath.Join(d.dir, names[0]+suffix)); err != nil && !os.IsNotExist(err) {
+				glog.Errorf("Can't remove dump %s: %v", names[0]+suffix, err)
+			}
+		}
+		total -= sizes[names[0]]
+		names = names[1:]
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// reason of the event recorded on a mutated object
+const eventReasonDefaultsApplied = "DefaultsApplied"
+
+// newEventRecorder returns a recorder that sends events to the API server in
+// the background. Failures to send are logged and otherwise ignored.
+func newEventRecorder(client kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: appName})
+}
+
+// requestObjectReference refers to the object of an admission request. On
+// CREATE the object has no UID yet, so the event is only tied to its name.
+func requestObjectReference(req *v1beta1.AdmissionRequest, metadata *metav1.ObjectMeta) *corev1.ObjectReference {
+	apiVersion := req.Kind.Version
+	if req.Kind.Group != "" {
+		apiVersion = req.Kind.Group + "/" + apiVersion
+	}
+	return &corev1.ObjectReference{
+		Kind:       req.Kind.Kind,
+		APIVersion: apiVersion,
+		Namespace:  metadata.Namespace,
+		Name:       metadata.Name,
+		UID:        metadata.UID,
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"k8s.io/api/admission/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// decodeIngress decodes the ingress of an admission request in whichever
+// version it was sent, going by req.Kind rather than the version the webhook
+// rule matched. The webhook works on networking/v1beta1 internally, so
+// networking/v1 ingresses are converted.
+func decodeIngress(req *v1beta1.AdmissionRequest) (*networkingv1beta1.Ingress, error) {
+	switch gv := req.Kind.Group + "/" + req.Kind.Version; gv {
+	case "extensions/v1beta1", "networking.k8s.io/v1beta1":
+		// extensions/v1beta1 serializes the same as networking/v1beta1
+		var ingress networkingv1beta1.Ingress
+		if err := json.Unmarshal(req.Object.Raw, &ingress); err != nil {
+			return nil, err
+		}
+		return &ingress, nil
+	case "networking.k8s.io/v1":
+		var ingress networkingv1.Ingress
+		if err := json.Unmarshal(req.Object.Raw, &ingress); err != nil {
+			return nil, err
+		}
+		return convertIngressV1(&ingress), nil
+	default:
+		return nil, fmt.Errorf("unsupported ingress version %s", gv)
+	}
+}
+
+// ingressClassAnnotation is the legacy way of choosing the class of an
+// ingress, replaced by spec.ingressClassName
+const ingressClassAnnotation = "kubernetes.io/ingress.class"
+
+// effectiveIngressClass returns the class of the ingress from
+// spec.ingressClassName or, when that isn't set, the legacy annotation
+func effectiveIngressClass(ingress *networkingv1beta1.Ingress) string {
+	if ingress.Spec.IngressClassName != nil && *ingress.Spec.IngressClassName != "" {
+		return *ingress.Spec.IngressClassName
+	}
+	return ingress.Annotations[ingressClassAnnotation]
+}
+
+// ingressClassPatch returns the operations moving the class of an ingress
+// from the legacy annotation to spec.ingressClassName. The API server doesn't
+// accept both, so the annotation is removed.
+func ingressClassPatch(ingress *networkingv1beta1.Ingress) []patchOperation {
+	class, ok := ingress.Annotations[ingressClassAnnotation]
+	if !ok || ingress.Spec.IngressClassName != nil {
+		return nil
+	}
+	return []patchOperation{
+		{Op: "add", Path: "/spec/ingressClassName", Value: class},
+		{Op: "remove", Path: "/metadata/annotations/" + escapeJSONPointer(ingressClassAnnotation)},
+	}
+}
+
+// pathTypes are the values of pathType an ingress path can have
+var pathTypes = []string{
+	string(networkingv1beta1.PathTypeExact),
+	string(networkingv1beta1.PathTypePrefix),
+	string(networkingv1beta1.PathTypeImplementationSpecific),
+}
+
+// pathTypePatch returns the operations setting pathType on the paths of the
+// ingress rules that have none
+func pathTypePatch(ingress *networkingv1beta1.Ingress, pathType string) []patchOperation {
+	var patch []patchOperation
+	for i, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for j, path := range rule.HTTP.Paths {
+			if path.PathType == nil {
+				patch = append(patch, patchOperation{
+					Op:    "add",
+					Path:  fmt.Sprintf("/spec/rules/%d/http/paths/%d/pathType", i, j),
+					Value: pathType,
+				})
+			}
+		}
+	}
+	return patch
+}
+
+// tlsSecretName is the conventional name of the secret for host, e.g.
+// shop-example-com-tls for shop.example.com and wildcard-example-com-tls for
+// *.example.com
+func tlsSecretName(host string) string {
+	name := strings.Replace(strings.Replace(host, "*", "wildcard", 1), ".", "-", -1)
+	return strings.ToLower(name) + "-tls"
+}
+
+// tlsPatch returns the operation adding a spec.tls entry with a conventionally
+// named secret for every host of an ingress without spec.tls. An ingress with
+// any spec.tls is left alone, its hosts may be served without TLS on purpose.
+func tlsPatch(ingress *networkingv1beta1.Ingress) []patchOperation {
+	if len(ingress.Spec.TLS) > 0 {
+		return nil
+	}
+	hosts := ingressHosts(ingress)
+	if len(hosts) == 0 {
+		return nil
+	}
+	tls := make([]networkingv1beta1.IngressTLS, 0, len(hosts))
+	for _, host := range hosts {
+		tls = append(tls, networkingv1beta1.IngressTLS{Hosts: []string{host}, SecretName: tlsSecretName(host)})
+	}
+	return []patchOperation{{Op: "add", Path: "/spec/tls", Value: tls}}
+}
+
+func convertIngressV1(in *networkingv1.Ingress) *networkingv1beta1.Ingress {
+	out := &networkingv1beta1.Ingress{
+		ObjectMeta: in.ObjectMeta,
+		Spec: networkingv1beta1.IngressSpec{
+			IngressClassName: in.Spec.IngressClassName,
+			Backend:          convertBackendV1(in.Spec.DefaultBackend),
+		},
+	}
+	for _, tls := range in.Spec.TLS {
+		out.Spec.TLS = append(out.Spec.TLS, networkingv1beta1.IngressTLS{Hosts: tls.Hosts, SecretName: tls.SecretName})
+	}
+	for _, rule := range in.Spec.Rules {
+		r := networkingv1beta1.IngressRule{Host: rule.Host}
+		if rule.HTTP != nil {
+			r.HTTP = &networkingv1beta1.HTTPIngressRuleValue{}
+			for _, path := range rule.HTTP.Paths {
+				p := networkingv1beta1.HTTPIngressPath{Path: path.Path}
+				if path.PathType != nil {
+					pathType := networkingv1beta1.PathType(*path.PathType)
+					p.PathType = &pathType
+				}
+				if backend := convertBackendV1(&path.Backend); backend != nil {
+					p.Backend = *backend
+				}
+				r.HTTP.Paths = append(r.HTTP.Paths, p)
+			}
+		}
+		out.Spec.Rules = append(out.Spec.Rules, r)
+	}
+	return out
+}
+
+func convertBackendV1(in *networkingv1.IngressBackend) *networkingv1beta1.IngressBackend {
+	if in == nil {
+		return nil
+	}
+	out := &networkingv1beta1.IngressBackend{Resource: in.Resource}
+	if in.Service != nil {
+		out.ServiceName = in.Service.Name
+		if in.Service.Port.Name != "" {
+			out.ServicePort = intstr.FromString(in.Service.Port.Name)
+		} else {
+			out.ServicePort = intstr.FromInt(int(in.Service.Port.Number))
+		}
+	}
+	return out
+}
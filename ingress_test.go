@@ -0,0 +1,154 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// httpRule returns a rule for host with a path for each of pathTypes, an
+// empty one leaving the pathType out
+func httpRule(host string, pathTypes ...string) networkingv1beta1.IngressRule {
+	rule := networkingv1beta1.IngressRule{Host: host, IngressRuleValue: networkingv1beta1.IngressRuleValue{HTTP: &networkingv1beta1.HTTPIngressRuleValue{}}}
+	for _, pathType := range pathTypes {
+		path := networkingv1beta1.HTTPIngressPath{Path: "/", Backend: networkingv1beta1.IngressBackend{ServiceName: "web"}}
+		if pathType != "" {
+			pt := networkingv1beta1.PathType(pathType)
+			path.PathType = &pt
+		}
+		rule.HTTP.Paths = append(rule.HTTP.Paths, path)
+	}
+	return rule
+}
+
+func TestMutateDefaultPathType(t *testing.T) {
+	whsvr := newTestServer(t, `[]`)
+	whsvr.defaultPathType = "Prefix"
+	ingress := testIngress("default", "web", nil)
+	ingress.Spec.Rules = []networkingv1beta1.IngressRule{
+		httpRule("a.example.com", "", "Exact"),
+		{Host: "no-http.example.com"},
+		httpRule("c.example.com", "ImplementationSpecific", "", ""),
+	}
+	patch := mutatePatch(t, whsvr, ingressReview(t, ingress))
+	want := `[{"op":"add","path":"/spec/rules/0/http/paths/0/pathType","value":"Prefix"},` +
+		`{"op":"add","path":"/spec/rules/2/http/paths/1/pathType","value":"Prefix"},` +
+		`{"op":"add","path":"/spec/rules/2/http/paths/2/pathType","value":"Prefix"}]`
+	if patch != want {
+		t.Fatalf("patch = %s, want %s", patch, want)
+	}
+	patched := patchedIngress(t, ingress, patch)
+	wantTypes := [][]string{{"Prefix", "Exact"}, nil, {"ImplementationSpecific", "Prefix", "Prefix"}}
+	for i, rule := range patched.Spec.Rules {
+		if rule.HTTP == nil {
+			if wantTypes[i] != nil {
+				t.Errorf("rule %d lost its paths", i)
+			}
+			continue
+		}
+		for j, path := range rule.HTTP.Paths {
+			if path.PathType == nil || string(*path.PathType) != wantTypes[i][j] {
+				t.Errorf("rule %d path %d has pathType %v, want %s", i, j, path.PathType, wantTypes[i][j])
+			}
+		}
+	}
+
+	// with every path typed there's nothing to do
+	if patch := mutatePatch(t, whsvr, ingressReview(t, patched)); patch != "" {
+		t.Errorf("patch = %s, want none", patch)
+	}
+}
+
+func TestMutateBackends(t *testing.T) {
+	whsvr := newTestServer(t, `[{"ingressName": "*", "defaultAnnotations": {"example.com/upstreams": "pool:${BACKENDS}", "other": "1"}}]`)
+	withBackends := func(defaultBackend string, services ...string) *networkingv1beta1.Ingress {
+		ingress := testIngress("default", "web", nil)
+		if defaultBackend != "" {
+			ingress.Spec.Backend = &networkingv1beta1.IngressBackend{ServiceName: defaultBackend}
+		}
+		rule := httpRule("a.example.com")
+		for _, service := range services {
+			backend := networkingv1beta1.IngressBackend{ServiceName: service}
+			if service == "" {
+				apiGroup := "example.com"
+				backend.Resource = &corev1.TypedLocalObjectReference{APIGroup: &apiGroup, Kind: "Bucket", Name: "static"}
+			}
+			rule.HTTP.Paths = append(rule.HTTP.Paths, networkingv1beta1.HTTPIngressPath{Path: "/", Backend: backend})
+		}
+		ingress.Spec.Rules = []networkingv1beta1.IngressRule{rule}
+		return ingress
+	}
+	v1 := ingressReview(t, testIngress("default", "web", nil))
+	v1.Request.Kind = metav1.GroupVersionKind{Group: "networking.k8s.io", Version: "v1", Kind: "Ingress"}
+	v1.Request.Object.Raw = []byte(`{"apiVersion":"networking.k8s.io/v1","kind":"Ingress","metadata":{"namespace":"default","name":"web"},"spec":{"rules":[{"http":{"paths":[` +
+		`{"path":"/","pathType":"Prefix","backend":{"service":{"name":"web","port":{"number":80}}}},` +
+		`{"path":"/static","pathType":"Prefix","backend":{"resource":{"apiGroup":"example.com","kind":"Bucket","name":"static"}}},` +
+		`{"path":"/api","pathType":"Prefix","backend":{"service":{"name":"api","port":{"name":"http"}}}}]}}]}}`)
+	tests := []struct {
+		name string
+		ar   *v1beta1.AdmissionReview
+		want string // empty without the annotation
+	}{
+		{"single backend", ingressReview(t, withBackends("", "web")), "pool:web"},
+		{"multiple backends", ingressReview(t, withBackends("default", "web", "api", "web")), "pool:default,web,api"},
+		{"resource backends are left out", ingressReview(t, withBackends("", "", "web")), "pool:web"},
+		{"no service backend", ingressReview(t, withBackends("", "")), ""},
+		{"networking/v1", v1, "pool:web,api"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := mutatedAnnotations(t, whsvr, tt.ar)
+			if got := annotations["example.com/upstreams"]; got != tt.want {
+				t.Errorf("upstreams = %q, want %q", got, tt.want)
+			}
+			if annotations["other"] != "1" {
+				t.Errorf("annotations = %v, want the other default too", annotations)
+			}
+		})
+	}
+}
+
+func TestMutateDefaultTLS(t *testing.T) {
+	whsvr := newTestServer(t, `[]`)
+	whsvr.defaultTLS = true
+	withHosts := func(tls []networkingv1beta1.IngressTLS, hosts ...string) *networkingv1beta1.Ingress {
+		ingress := testIngress("default", "web", nil)
+		for _, host := range hosts {
+			ingress.Spec.Rules = append(ingress.Spec.Rules, networkingv1beta1.IngressRule{Host: host})
+		}
+		ingress.Spec.TLS = tls
+		return ingress
+	}
+	partial := []networkingv1beta1.IngressTLS{{Hosts: []string{"shop.example.com"}, SecretName: "shop"}}
+	tests := []struct {
+		name    string
+		ingress *networkingv1beta1.Ingress
+		want    []networkingv1beta1.IngressTLS
+	}{
+		{"one host", withHosts(nil, "shop.example.com"),
+			[]networkingv1beta1.IngressTLS{{Hosts: []string{"shop.example.com"}, SecretName: "shop-example-com-tls"}}},
+		{"a secret for every host", withHosts(nil, "Shop.example.com", "*.example.com", "", "Shop.example.com"),
+			[]networkingv1beta1.IngressTLS{
+				{Hosts: []string{"Shop.example.com"}, SecretName: "shop-example-com-tls"},
+				{Hosts: []string{"*.example.com"}, SecretName: "wildcard-example-com-tls"},
+			}},
+		{"partial tls is kept", withHosts(partial, "shop.example.com", "api.example.com"), partial},
+		{"no hosts", withHosts(nil, ""), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch := mutatePatch(t, whsvr, ingressReview(t, tt.ingress))
+			got := tt.ingress.Spec.TLS
+			if patch != "" {
+				got = patchedIngress(t, tt.ingress, patch).Spec.TLS
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("spec.tls = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// getKubeClient returns a client for the cluster the webhook runs in. Outside
+// a cluster it falls back to $KUBECONFIG and then ~/.kube/config so that the
+// webhook can be run locally.
+func getKubeClient() (kubernetes.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		kubeconfig := os.Getenv(clientcmd.RecommendedConfigPathEnvVar)
+		if kubeconfig == "" {
+			home, herr := os.UserHomeDir()
+			if herr != nil {
+				return nil, fmt.Errorf("not running in a cluster (%v) and no home directory to find a kubeconfig in: %v", err, herr)
+			}
+			kubeconfig = filepath.Join(home, clientcmd.RecommendedHomeDir, clientcmd.RecommendedFileName)
+		}
+		var kerr error
+		config, kerr = clientcmd.BuildConfigFromFlags("", kubeconfig)
+		if kerr != nil {
+			return nil, fmt.Errorf("not running in a cluster (%v) and could not load kubeconfig %s: %v", err, kubeconfig, kerr)
+		}
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return clientset, nil
+}
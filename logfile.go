@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+
+	"github.com/golang/glog"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// redirectLogs sends everything written to stderr, glog included, to a file
+// that is rotated once it grows past maxSizeMB. glog can't write to an
+// io.Writer, so it is switched to stderr only and os.Stderr is replaced with a
+// pipe into the file. The returned function flushes and closes the file.
+func redirectLogs(path string, maxSizeMB int) (func(), error) {
+	out := &lumberjack.Logger{
+		Filename: path,
+		MaxSize:  maxSizeMB,
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := flag.Set("logtostderr", "true"); err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(out, r)
+		close(done)
+	}()
+	stderr := os.Stderr
+	os.Stderr = w
+
+	return func() {
+		glog.Flush()
+		os.Stderr = stderr
+		w.Close()
+		<-done
+		out.Close()
+	}, nil
+}
@@ -3,16 +3,21 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
@@ -20,53 +25,496 @@ func main() {
 
 	// get command line parameters
 	flag.IntVar(&parameters.port, "port", 443, "Webhook server port.")
+	flag.IntVar(&parameters.insecurePort, "insecurePort", 0, "Port for a plain HTTP listener serving only /healthz, /readyz and /metrics. 0 disables it.")
+	flag.StringVar(&parameters.bindAddress, "bindAddress", "", "Address to listen on, e.g. the pod IP or 127.0.0.1 behind a sidecar proxy. Empty listens on all interfaces.")
 	flag.StringVar(&parameters.certFile, "tlsCertFile", "/etc/webhook/certs/cert.pem", "File containing the x509 Certificate for HTTPS.")
 	flag.StringVar(&parameters.keyFile, "tlsKeyFile", "/etc/webhook/certs/key.pem", "File containing the x509 private key to --tlsCertFile.")
+	flag.StringVar(&parameters.certSecretName, "certSecretName", "", "Name of a kubernetes.io/tls Secret to load the x509 certificate and key from. Overrides --tlsCertFile and --tlsKeyFile.")
+	flag.StringVar(&parameters.certSecretNamespace, "certSecretNamespace", "default", "Namespace of the Secret named by --certSecretName.")
+	flag.StringVar(&parameters.certDir, "certDir", "", "Directory of <hostname>.crt and <hostname>.key pairs served to clients asking for that hostname through SNI. Other clients get the certificate from --tlsCertFile or --certSecretName.")
+	flag.StringVar(&parameters.expectedDNSName, "expectedDNSName", "", "DNS name the serving certificate is checked against at startup. Defaults to <--serviceName>.<--serviceNamespace>.svc, the name the API server connects to.")
+	flag.BoolVar(&parameters.insecure, "insecure", false, "Serve admission requests over plain HTTP instead of TLS, for local development only. Never use it in production.")
+	flag.BoolVar(&parameters.strictCert, "strictCert", false, "Exit at startup when the serving certificate is not valid for --expectedDNSName, instead of logging a warning.")
 	flag.StringVar(&parameters.annotationCfg, "annotationCfgFile", "/etc/config/default-annotations.json", "File containing default annotations for each named ingress")
+	flag.StringVar(&parameters.pauseConfigMap, "pauseConfigMap", "", "namespace/name of a ConfigMap to watch; while its \"paused\" key is \"true\" every request is allowed untouched. Empty disables it.")
+	flag.StringVar(&parameters.watchNamespace, "watchNamespace", os.Getenv("WATCH_NAMESPACE"), "Only handle objects in this namespace and allow all others untouched, for one webhook instance per team. Defaults to $WATCH_NAMESPACE; empty handles every namespace.")
+	flag.StringVar(&parameters.defaultNamespace, "defaultNamespace", "", "Namespace for default annotations entries that don't give one. Entries with namespace \"*\" still apply in every namespace.")
+	flag.DurationVar(&parameters.remoteTimeout, "remoteAnnotationsTimeout", 10*time.Second, "How long fetching the document of a defaultAnnotationsURL may take.")
+	flag.BoolVar(&parameters.disableRemote, "disableRemoteAnnotations", false, "Never fetch defaultAnnotationsURL documents, using the inline defaultAnnotations of those entries instead. For clusters without access to the annotation service.")
+	flag.StringVar(&parameters.policyCfg, "policyCfgFile", "", "Optional JSON file with noMutateNamespaces, noValidateNamespaces, forbiddenAnnotations and allowedAnnotations lists, overriding the matching flags. Re-read on SIGHUP.")
+	flag.StringVar(&parameters.noMutateNamespaces, "noMutateNamespaces", strings.Join(ignoredNamespaces, ","), "Comma separated namespaces whose objects are never mutated.")
+	flag.StringVar(&parameters.noValidateNamespaces, "noValidateNamespaces", strings.Join(ignoredNamespaces, ","), "Comma separated namespaces whose ingresses are never validated.")
+	flag.StringVar(&parameters.auditLogFile, "auditLogFile", "", "File to append a JSON line to for every applied mutation, or \"-\" for stdout. Empty (default) disables the audit log.")
+	flag.IntVar(&parameters.auditMaxSizeMB, "auditMaxSizeMB", 0, "Size in megabytes at which --auditLogFile is rotated. 0 never rotates it.")
+	flag.IntVar(&parameters.auditMaxBackups, "auditMaxBackups", 0, "Number of rotated audit log files to keep. 0 keeps all of them.")
+	flag.BoolVar(&parameters.auditCompress, "auditCompress", false, "Gzip rotated audit log files.")
+	flag.StringVar(&parameters.decisionSinkURL, "decisionSink", "", "URL to POST a JSON summary of every mutation and validation decision to, in the background. Empty disables it.")
+	flag.IntVar(&parameters.responseCacheSize, "responseCacheSize", 0, "Responses to keep by request UID, so a request the API server retries gets the same answer without being computed again. 0 disables the cache.")
+	flag.DurationVar(&parameters.responseCacheTTL, "responseCacheTTL", 30*time.Second, "How long a response is kept for retries of the same request.")
+	flag.DurationVar(&parameters.orphanCheckInterval, "orphanCheckInterval", time.Hour, "How often to warn about config entries whose ingressName matches no existing ingress, also checked after every reload. 0 disables the check.")
+	flag.IntVar(&parameters.decisionSinkQueue, "decisionSinkQueueSize", 1000, "Decisions waiting to be sent to --decisionSink before new ones are dropped.")
+	flag.StringVar(&parameters.dumpDir, "dumpDir", "", "Directory to write every admission request and the response to as a pair of JSON files, to replay them offline. Empty disables it.")
+	flag.IntVar(&parameters.dumpMaxFiles, "dumpMaxFiles", 1000, "Request and response pairs kept in --dumpDir before the oldest are removed. 0 keeps all of them.")
+	flag.IntVar(&parameters.dumpMaxSizeMB, "dumpMaxSizeMB", 100, "Size in megabytes of the files kept in --dumpDir before the oldest are removed. 0 for no limit.")
+	flag.BoolVar(&parameters.strictEnv, "strictEnv", false, "Reject the mutation when a ${ENV:NAME} reference in a default annotation names an unset environment variable, instead of expanding it to an empty string.")
+	flag.StringVar(&parameters.allowedKinds, "allowedKinds", kindIngress+","+kindService, "Comma separated kinds of objects to mutate. Requests for other kinds, sent by too broad webhook rules, are allowed unchanged with a warning. Empty handles every kind the webhook can decode.")
+	flag.StringVar(&parameters.defaultPathType, "defaultPathType", "", "pathType to set on ingress paths that have none, one of "+strings.Join(pathTypes, ", ")+". Applied to every mutated ingress, whether a config entry matches or not. Empty leaves paths alone.")
+	flag.BoolVar(&parameters.emitEvents, "emitEvents", false, "Record a "+eventReasonDefaultsApplied+" event naming the config entries on every object the webhook mutates, shown by kubectl describe. Needs the kubernetes client.")
+	flag.BoolVar(&parameters.revertUnmatched, "revertUnmatched", false, "Record the annotations added to an object in "+admissionWebhookAnnotationManagedKey+" and remove them on update once no config entry sets them anymore, along with the status annotation.")
+	flag.StringVar(&parameters.statusKey, "statusAnnotationKey", admissionWebhookAnnotationStatusKey, "Annotation that marks an object as already handled. Use a key of your own when several webhooks run in the cluster.")
+	flag.StringVar(&parameters.statusValue, "statusAnnotationValue", admissionWebhookStatusMutated, "Value of --statusAnnotationKey, compared case insensitively, for which the object is not mutated again.")
+	flag.BoolVar(&parameters.useInformerCache, "useInformerCache", false, "Serve the namespace label lookups from a shared informer cache instead of asking the API server on every request. Ingresses are always read from an informer cache.")
+	flag.BoolVar(&parameters.checkPortConflicts, "checkPortConflicts", false, "Reject an ingress asking for an ingress.citrix.com/secure-port or insecure-port that another ingress on the same ingress.citrix.com/frontend-ip already uses.")
+	flag.BoolVar(&parameters.validateShadow, "validateShadow", false, "Only log and count the requests validation would reject, allowing all of them.")
+	flag.BoolVar(&parameters.defaultTLS, "defaultTLS", false, "Add spec.tls to ingresses without it, with a secret named after each host, e.g. shop-example-com-tls for shop.example.com.")
+	flag.BoolVar(&parameters.migrateIngressClass, "migrateIngressClass", false, "Move the class of ingresses from the "+ingressClassAnnotation+" annotation to spec.ingressClassName.")
+	flag.BoolVar(&parameters.caseSensitiveMatch, "caseSensitiveMatch", false, "Match ingressName to object names with case instead of ignoring it.")
+	flag.StringVar(&parameters.allowedClasses, "allowedIngressClasses", "", "Comma separated ingress classes validation allows, from spec.ingressClassName or the "+ingressClassAnnotation+" annotation. Empty allows all.")
+	flag.BoolVar(&parameters.allowEmptyClass, "allowEmptyClass", true, "Allow ingresses without a class when --allowedIngressClasses is set.")
+	flag.BoolVar(&parameters.requireBackend, "requireBackend", false, "Reject ingresses that have neither a default backend nor any rules, unless annotated with "+admissionWebhookAnnotationAllowNoBackendKey+": \"true\".")
+	flag.DurationVar(&parameters.listerTimeout, "listerTimeout", 5*time.Second, "How long validation waits for the list of existing ingresses. 0 waits indefinitely.")
+	flag.StringVar(&parameters.caseCollisions, "annotationCaseCollisions", caseCollisionsWarn, "What validation does with an ingress whose annotation keys differ only by case, like Example.com/foo and example.com/foo: \"warn\" admits it with a warning, \"reject\" rejects it, \"allow\" ignores it.")
+	flag.StringVar(&parameters.listerFailure, "listerFailurePolicy", listerFailureDeny, "What validation does when the existing ingresses can't be listed in time or the informer cache hasn't synced: \"deny\" rejects the ingress, \"allow\" admits it without the port conflict check.")
+	flag.DurationVar(&parameters.requestTimeout, "requestTimeout", 8*time.Second, "Deadline for answering an admission request, cancelling the API server calls made for it. Keep it below the timeoutSeconds of the webhook configuration (10s by default); the shorter timeout the API server sends with each request is honored too. 0 only honors the API server timeout.")
+	flag.IntVar(&parameters.maxConcurrent, "maxConcurrentRequests", 0, "Maximum number of admission requests handled at once. Requests above the limit get a 429. 0 means no limit.")
+	flag.StringVar(&parameters.otlpEndpoint, "otlpEndpoint", "", "host:port of an OTLP/gRPC collector to export admission traces to. Tracing is disabled when empty.")
+	flag.BoolVar(&parameters.otlpInsecure, "otlpInsecure", false, "Connect to --otlpEndpoint without TLS.")
+	flag.StringVar(&parameters.forbiddenAnns, "forbiddenAnnotations", "", "Comma separated annotations that validation rejects ingresses for. A trailing * matches any suffix.")
+	flag.BoolVar(&parameters.lockdown, "lockdown", false, "Reject every ingress create and update, to freeze changes during an incident.")
+	flag.StringVar(&parameters.lockdownAllowedUsers, "lockdownAllowedUsers", "", "Comma separated users, e.g. system:serviceaccount:NAMESPACE:NAME, whose changes --lockdown lets through.")
+	flag.StringVar(&parameters.allowedAnns, "allowedAnnotations", "", "Comma separated annotations ingresses may carry; validation rejects any other. A trailing * matches any suffix. Empty allows all.")
+	flag.StringVar(&parameters.logFile, "logFile", "", "File to write the logs to instead of stderr, rotated at --logMaxSizeMB. Overrides the glog --logtostderr and --log_dir flags.")
+	flag.IntVar(&parameters.logMaxSizeMB, "logMaxSizeMB", 100, "Size in megabytes at which --logFile is rotated.")
+	flag.BoolVar(&parameters.warnDecisions, "debugMatch", false, "Add a warning to every mutation response saying which config entries matched or why the object was skipped. kubectl prints it; meant for troubleshooting only.")
+	flag.StringVar(&parameters.debugClientCAFile, "debugClientCAFile", "", "PEM bundle of the CAs whose client certificates may call the /debug/match endpoint. The endpoint is disabled when empty.")
+	flag.BoolVar(&parameters.enablePprof, "enablePprof", false, "Serve the net/http/pprof profiling handlers on 127.0.0.1:--pprofPort.")
+	flag.IntVar(&parameters.pprofPort, "pprofPort", 6060, "Localhost port for --enablePprof.")
+	flag.StringVar(&parameters.validateCfg, "validateConfig", "", "Check the given default annotations file, print any problems and exit without starting the server.")
+	flag.BoolVar(&parameters.selfRegister, "selfRegister", false, "Create or update the MutatingWebhookConfiguration at startup, pointing at --serviceName in --serviceNamespace with the CA from --caBundleFile. Exits if that fails.")
+	flag.BoolVar(&parameters.printDefaults, "printDefaults", false, "Print the value of every flag and the default annotations and policy as the server would use them, as JSON, and exit.")
+	flag.BoolVar(&parameters.genManifests, "genManifests", false, "Print the Deployment, Service and MutatingWebhookConfiguration to install the webhook and exit.")
+	flag.StringVar(&parameters.manifests.serviceName, "serviceName", "admission-webhook-example-svc", "Name of the webhook Service in the manifests printed by --genManifests and the configuration registered by --selfRegister.")
+	flag.StringVar(&parameters.manifests.namespace, "serviceNamespace", "default", "Namespace to install the webhook into in the manifests printed by --genManifests and the configuration registered by --selfRegister.")
+	flag.StringVar(&parameters.manifests.image, "image", "chiradeep/admission-webhook-example:v1", "Webhook image in the manifests printed by --genManifests.")
+	flag.BoolVar(&parameters.emitWebhookCfg, "emitWebhookConfig", false, "Print the MutatingWebhookConfiguration with the caBundle filled in and exit, for kubectl apply.")
+	flag.StringVar(&parameters.manifests.webhookPath, "webhookPath", "/mutate", "Path of the webhook in the configuration printed by --genManifests and --emitWebhookConfig and registered by --selfRegister.")
+	flag.StringVar(&parameters.manifests.failurePolicy, "failurePolicy", "", "failurePolicy, Fail or Ignore, of the configuration printed by --genManifests and --emitWebhookConfig and registered by --selfRegister. Empty leaves the API server default.")
+	flag.StringVar(&parameters.manifests.caBundleFile, "caBundleFile", "", "PEM file with the CA the API server should trust, for --genManifests and --selfRegister. Defaults to --tlsCertFile.")
 	flag.Parse()
 
-	pair, err := tls.LoadX509KeyPair(parameters.certFile, parameters.keyFile)
-	if err != nil {
-		glog.Errorf("Failed to load key pair: %v", err)
+	if parameters.validateCfg != "" {
+		os.Exit(validateConfigFile(parameters.validateCfg, parameters.defaultNamespace))
+	}
+	parameters.manifests.port = parameters.port
+	if parameters.manifests.caBundleFile == "" {
+		parameters.manifests.caBundleFile = parameters.certFile
+	}
+	switch parameters.manifests.failurePolicy {
+	case "", "Fail", "Ignore":
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid --failurePolicy %q, must be Fail or Ignore\n", parameters.manifests.failurePolicy)
+		os.Exit(2)
+	}
+	if parameters.emitWebhookCfg {
+		if err := printWebhookConfig(os.Stdout, parameters.manifests); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to generate the webhook configuration: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if parameters.genManifests {
+		if err := printManifests(os.Stdout, parameters.manifests); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to generate manifests: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
 
-	var defaultAnnotations []map[string]interface{}
-	jsonFile, err := os.Open(parameters.annotationCfg)
-	if err != nil {
+	if parameters.logFile != "" {
+		closeLogs, err := redirectLogs(parameters.logFile, parameters.logMaxSizeMB)
+		if err != nil {
+			glog.Errorf("Failed to log to %s: %v", parameters.logFile, err)
+		} else {
+			defer closeLogs()
+		}
+	}
+
+	defaultAnnotations, errs := loadAnnotationConfig(parameters.annotationCfg, parameters.defaultNamespace)
+	for _, err := range errs {
 		glog.Errorf("Failed to load default annotations: %v", err)
 	}
-	byteValue, _ := ioutil.ReadAll(jsonFile)
-	_ = json.Unmarshal([]byte(byteValue), &defaultAnnotations)
+	for _, warning := range configWarnings(defaultAnnotations) {
+		glog.Warningf("Default annotations: %s", warning)
+	}
+	remote := newRemoteAnnotations(parameters.remoteTimeout, parameters.disableRemote)
+	defaultAnnotations = remote.resolve(defaultAnnotations)
 	glog.Infof("Unmarshaled: %v", defaultAnnotations)
 
+	basePolicy := policyConfig{
+		NoMutateNamespaces:   splitList(parameters.noMutateNamespaces),
+		NoValidateNamespaces: splitList(parameters.noValidateNamespaces),
+		ForbiddenAnnotations: splitList(parameters.forbiddenAnns),
+		AllowedAnnotations:   splitList(parameters.allowedAnns),
+		Lockdown:             parameters.lockdown,
+		LockdownAllowedUsers: splitList(parameters.lockdownAllowedUsers),
+	}
+	policy, err := loadPolicyConfig(basePolicy, parameters.policyCfg)
+	if err != nil {
+		glog.Errorf("Failed to load policy: %v", err)
+	}
+	// admission waits for a SIGHUP that loads both files when this fails;
+	// problems with single entries only cost those entries
+	configLoaded := entryErrorsOnly(errs) && err == nil
+	glog.Infof("Policy: %+v", policy)
+
+	if parameters.printDefaults {
+		if err := printEffectiveConfig(os.Stdout, defaultAnnotations, policy); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to print the configuration: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	stopCh := make(chan struct{})
+
+	shutdownTracing, err := setupTracing(context.Background(), parameters.otlpEndpoint, parameters.otlpInsecure)
+	if err != nil {
+		glog.Errorf("Failed to set up tracing: %v", err)
+		shutdownTracing = func(context.Context) error { return nil }
+	}
+
+	// the API server is optional: without it the webhook still serves its
+	// file based configuration
+	kubeClient, err := getKubeClient()
+	if err != nil {
+		glog.Warningf("No kubernetes client, features that need the API server are disabled: %v", err)
+	}
+
+	tlsConfig := &tls.Config{}
+	if parameters.insecure {
+		glog.Warningf("Serving admission requests over plain HTTP because of --insecure. This is for local development only and must never be used in production.")
+	} else {
+		if parameters.certSecretName != "" && kubeClient != nil {
+			certLoader := newSecretCertLoader(kubeClient, parameters.certSecretNamespace, parameters.certSecretName)
+			if err := certLoader.load(); err != nil {
+				glog.Errorf("Failed to load key pair from secret: %v", err)
+			}
+			certLoader.watch(stopCh)
+			tlsConfig.GetCertificate = certLoader.GetCertificate
+		} else {
+			if parameters.certSecretName != "" {
+				glog.Warningf("Can't read secret %s/%s without a kubernetes client, falling back to --tlsCertFile/--tlsKeyFile", parameters.certSecretNamespace, parameters.certSecretName)
+			}
+			pair, err := tls.LoadX509KeyPair(parameters.certFile, parameters.keyFile)
+			if err != nil {
+				glog.Errorf("Failed to load key pair: %v", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+		if parameters.certDir != "" {
+			primary := tlsConfig.GetCertificate
+			if primary == nil {
+				pair := &tlsConfig.Certificates[0]
+				primary = func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return pair, nil }
+			}
+			sniLoader, err := newSNICertLoader(parameters.certDir, primary)
+			if err != nil {
+				glog.Errorf("Failed to load certificates from %s: %v", parameters.certDir, err)
+			} else {
+				tlsConfig.Certificates = nil
+				tlsConfig.GetCertificate = sniLoader.GetCertificate
+			}
+		}
+		expectedDNSName := parameters.expectedDNSName
+		if expectedDNSName == "" {
+			expectedDNSName = parameters.manifests.serviceName + "." + parameters.manifests.namespace + ".svc"
+		}
+		if err := checkServingName(tlsConfig, expectedDNSName); err != nil {
+			if parameters.strictCert {
+				glog.Exitf("Serving certificate is not valid for %s: %v", expectedDNSName, err)
+			}
+			glog.Warningf("Serving certificate is not valid for %s, the API server will refuse to connect to it: %v", expectedDNSName, err)
+		}
+	}
+
+	auditLog, err := newAuditLogger(parameters.auditLogFile, parameters.auditMaxSizeMB, parameters.auditMaxBackups, parameters.auditCompress)
+	if err != nil {
+		glog.Errorf("Failed to open audit log: %v", err)
+	}
+
+	dumper, err := newRequestDumper(parameters.dumpDir, parameters.dumpMaxFiles, parameters.dumpMaxSizeMB)
+	if err != nil {
+		glog.Errorf("Failed to create the dump directory, not dumping requests: %v", err)
+	}
+
 	whsvr := &WebhookServer{
 		server: &http.Server{
-			Addr:      fmt.Sprintf(":%v", parameters.port),
-			TLSConfig: &tls.Config{Certificates: []tls.Certificate{pair}},
+			Addr:      net.JoinHostPort(parameters.bindAddress, strconv.Itoa(parameters.port)),
+			TLSConfig: tlsConfig,
 		},
-		defaultAnnotations: defaultAnnotations,
+		annotationCfgFile:   parameters.annotationCfg,
+		policyCfgFile:       parameters.policyCfg,
+		defaultNamespace:    parameters.defaultNamespace,
+		watchNamespace:      parameters.watchNamespace,
+		remote:              remote,
+		basePolicy:          basePolicy,
+		defaultAnnotations:  defaultAnnotations,
+		annotationIndex:     newAnnotationIndex(defaultAnnotations),
+		policy:              policy,
+		configLoaded:        configLoaded,
+		auditLog:            auditLog,
+		decisionSink:        newDecisionSink(parameters.decisionSinkURL, parameters.decisionSinkQueue),
+		responseCache:       newResponseCache(parameters.responseCacheSize, parameters.responseCacheTTL),
+		dumper:              dumper,
+		strictEnv:           parameters.strictEnv,
+		revertUnmatched:     parameters.revertUnmatched,
+		allowedKinds:        splitList(parameters.allowedKinds),
+		defaultPathType:     parameters.defaultPathType,
+		caseSensitiveMatch:  parameters.caseSensitiveMatch,
+		migrateIngressClass: parameters.migrateIngressClass,
+		defaultTLS:          parameters.defaultTLS,
+		statusKey:           parameters.statusKey,
+		statusValue:         parameters.statusValue,
+		validateShadow:      parameters.validateShadow,
+		requireBackend:      parameters.requireBackend,
+		allowedClasses:      splitList(parameters.allowedClasses),
+		allowEmptyClass:     parameters.allowEmptyClass,
+		warnDecisions:       parameters.warnDecisions,
+		listerTimeout:       parameters.listerTimeout,
+		checkPortConflicts:  parameters.checkPortConflicts,
+		requestTimeout:      parameters.requestTimeout,
+	}
+	if configLoaded {
+		configInUse(defaultAnnotations)
+	}
+	whsvr.updatePausedMetric()
+	if parameters.defaultPathType != "" && !containsString(pathTypes, parameters.defaultPathType) {
+		glog.Errorf("Unknown --defaultPathType %q, not defaulting path types", parameters.defaultPathType)
+		whsvr.defaultPathType = ""
+	}
+	switch parameters.listerFailure {
+	case listerFailureAllow:
+		whsvr.listerFailOpen = true
+	case listerFailureDeny:
+	default:
+		glog.Errorf("Unknown --listerFailurePolicy %q, denying when ingresses can't be listed", parameters.listerFailure)
+	}
+	switch parameters.caseCollisions {
+	case caseCollisionsAllow, caseCollisionsWarn, caseCollisionsReject:
+		whsvr.caseCollisions = parameters.caseCollisions
+	default:
+		glog.Errorf("Unknown --annotationCaseCollisions %q, warning about annotation keys that differ only by case", parameters.caseCollisions)
+		whsvr.caseCollisions = caseCollisionsWarn
+	}
+	if parameters.maxConcurrent > 0 {
+		whsvr.requestSlots = make(chan struct{}, parameters.maxConcurrent)
+	}
+	if parameters.emitEvents {
+		if kubeClient != nil {
+			whsvr.recorder = newEventRecorder(kubeClient)
+		} else {
+			glog.Warningf("Can't record events without a kubernetes client, ignoring --emitEvents")
+		}
+	}
+	if parameters.pauseConfigMap != "" {
+		namespace, name, ok := splitNamespacedName(parameters.pauseConfigMap)
+		switch {
+		case !ok:
+			glog.Errorf("Invalid --pauseConfigMap %q, must be namespace/name", parameters.pauseConfigMap)
+		case kubeClient == nil:
+			glog.Warningf("Can't watch ConfigMap %s without a kubernetes client, ignoring --pauseConfigMap", parameters.pauseConfigMap)
+		default:
+			whsvr.pauseConfigMap = watchPauseConfigMap(kubeClient, namespace, name, whsvr.updatePausedMetric, stopCh)
+		}
+	}
+	if kubeClient != nil {
+		// ingresses are only ever read from the cache, which is not started
+		// when nothing reads them
+		if parameters.checkPortConflicts || parameters.orphanCheckInterval > 0 || parameters.debugClientCAFile != "" {
+			whsvr.ingressLister = newCachedIngressLister(kubeClient, parameters.watchNamespace, stopCh)
+		}
+		if parameters.useInformerCache {
+			whsvr.namespaceLister = newCachedNamespaceLister(kubeClient, parameters.watchNamespace, stopCh)
+		} else {
+			whsvr.namespaceLister = &liveNamespaceLister{client: kubeClient}
+		}
+		if parameters.orphanCheckInterval > 0 {
+			whsvr.orphanCheck = make(chan struct{}, 1)
+			go whsvr.watchOrphanedEntries(parameters.orphanCheckInterval, stopCh)
+		}
 	}
 
 	// define http server and server handler
 	mux := http.NewServeMux()
 	mux.HandleFunc("/mutate", whsvr.serve)
 	mux.HandleFunc("/validate", whsvr.serve)
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", whsvr.readyz)
+	mux.Handle("/metrics", promhttp.Handler())
+	features := []string{"mutate", "validate", "metrics"}
+	if parameters.debugClientCAFile != "" {
+		roots, err := loadCertPool(parameters.debugClientCAFile)
+		if err != nil {
+			glog.Errorf("Failed to load debug client CA, debug endpoints disabled: %v", err)
+		} else {
+			tlsConfig.ClientAuth = tls.RequestClientCert
+			mux.HandleFunc("/debug/match", requireClientCert(roots, whsvr.debugMatch))
+			features = append(features, "debugMatch")
+		}
+	}
+	var optional []string
+	for feature, enabled := range map[string]bool{
+		"decisionSink":          whsvr.decisionSink != nil,
+		"emitEvents":            whsvr.recorder != nil,
+		"revertUnmatched":       whsvr.revertUnmatched,
+		"defaultPathType":       whsvr.defaultPathType != "",
+		"dumpDir":               whsvr.dumper != nil,
+		"defaultTLS":            whsvr.defaultTLS,
+		"migrateIngressClass":   whsvr.migrateIngressClass,
+		"orphanCheck":           whsvr.orphanCheck != nil,
+		"requireBackend":        whsvr.requireBackend,
+		"allowedIngressClasses": len(whsvr.allowedClasses) > 0,
+		"caseSensitiveMatch":    whsvr.caseSensitiveMatch,
+		"checkPortConflicts":    whsvr.checkPortConflicts,
+		"insecure":              parameters.insecure,
+		"pauseConfigMap":        whsvr.pauseConfigMap != nil,
+		"pprof":                 parameters.enablePprof,
+		"responseCache":         whsvr.responseCache != nil,
+		"selfRegister":          parameters.selfRegister,
+		"tracing":               parameters.otlpEndpoint != "",
+		"watchNamespace":        parameters.watchNamespace != "",
+	} {
+		if enabled {
+			optional = append(optional, feature)
+		}
+	}
+	sort.Strings(optional)
+	serveVersion := versionHandler(append(features, optional...))
+	mux.Handle("/version", serveVersion)
 	whsvr.server.Handler = mux
 
-	// start webhook server in new routine
+	// the configuration is in place before the listener accepts requests
 	go func() {
-		if err := whsvr.server.ListenAndServeTLS("", ""); err != nil {
+		serve := func() error { return whsvr.server.ListenAndServeTLS("", "") }
+		if parameters.insecure {
+			serve = whsvr.server.ListenAndServe
+		}
+		if err := serve(); err != nil {
 			glog.Errorf("Failed to listen and serve webhook server: %v", err)
 		}
 	}()
 
+	// probes and metrics without TLS, the admission endpoints stay TLS only
+	var insecureServer *http.Server
+	if parameters.insecurePort != 0 {
+		insecureMux := http.NewServeMux()
+		insecureMux.HandleFunc("/healthz", healthz)
+		insecureMux.HandleFunc("/readyz", whsvr.readyz)
+		insecureMux.Handle("/metrics", promhttp.Handler())
+		insecureMux.Handle("/version", serveVersion)
+		insecureServer = &http.Server{
+			Addr:    net.JoinHostPort(parameters.bindAddress, strconv.Itoa(parameters.insecurePort)),
+			Handler: insecureMux,
+		}
+		go func() {
+			if err := insecureServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				glog.Errorf("Failed to listen and serve plain HTTP server: %v", err)
+			}
+		}()
+	}
+
+	if parameters.enablePprof {
+		go servePprof(fmt.Sprintf("127.0.0.1:%v", parameters.pprofPort))
+	}
+
 	glog.Info("Server started")
 
+	if parameters.selfRegister {
+		if kubeClient == nil {
+			glog.Exitf("--selfRegister needs a kubernetes client")
+		}
+		caBundle, err := readCABundle(parameters.manifests.caBundleFile)
+		if err != nil {
+			glog.Exitf("Failed to register webhook: %v", err)
+		}
+		if err := registerWebhook(kubeClient, mutatingWebhookConfiguration(parameters.manifests, caBundle)); err != nil {
+			glog.Exitf("Failed to register webhook: %v", err)
+		}
+	}
+
 	// listening OS shutdown singal
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
-	<-signalChan
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signalChan {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		glog.Infof("Got SIGHUP, reloading configuration")
+		if err := whsvr.reloadConfig(); err != nil {
+			glog.Errorf("Failed to reload configuration, keeping the previous one: %v", err)
+			continue
+		}
+		glog.Infof("Reloaded: %v", whsvr.annotationConfig())
+		glog.Infof("Policy: %+v", whsvr.currentPolicy())
+	}
 
 	glog.Infof("Got OS shutdown signal, shutting down webhook server gracefully...")
+	close(stopCh)
 	whsvr.server.Shutdown(context.Background())
+	if insecureServer != nil {
+		insecureServer.Shutdown(context.Background())
+	}
+	if err := shutdownTracing(context.Background()); err != nil {
+		glog.Errorf("Failed to flush traces: %v", err)
+	}
+}
+
+// splitList splits a comma separated flag value, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// splitNamespacedName splits a namespace/name flag value
+func splitNamespacedName(value string) (namespace, name string, ok bool) {
+	parts := strings.Split(value, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// containsString reports whether value is one of list
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// healthz reports that the process is serving
+func healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// servePprof serves the profiling handlers on addr, which must not be
+// reachable from outside the pod
+func servePprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	glog.Infof("Serving pprof on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		glog.Errorf("Failed to serve pprof: %v", err)
+	}
 }
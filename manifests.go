@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	appName         = "admission-webhook-example"
+	certSecretName  = "admission-webhook-example-certs"
+	configMapName   = "default-annotations"
+	certMountPath   = "/etc/webhook/certs"
+	configMountPath = "/etc/config"
+)
+
+// manifestOptions describes the installation printed by -genManifests
+type manifestOptions struct {
+	serviceName  string
+	namespace    string
+	image        string
+	port         int
+	caBundleFile string // PEM bundle the API server should trust
+	webhookPath  string // path the API server posts reviews to
+	// failurePolicy of the webhook, Fail or Ignore; empty leaves the API
+	// server default
+	failurePolicy string
+}
+
+// printManifests writes the Deployment, Service and
+// MutatingWebhookConfiguration needed to run the webhook as a YAML stream
+func printManifests(w io.Writer, opts manifestOptions) error {
+	caBundle, err := readCABundle(opts.caBundleFile)
+	if err != nil {
+		return err
+	}
+	objects := []interface{}{
+		webhookDeployment(opts),
+		webhookService(opts),
+		mutatingWebhookConfiguration(opts, caBundle),
+	}
+	for _, obj := range objects {
+		out, err := yaml.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "---\n%s", out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printWebhookConfig writes only the MutatingWebhookConfiguration, with the
+// caBundle filled in, as YAML
+func printWebhookConfig(w io.Writer, opts manifestOptions) error {
+	caBundle, err := readCABundle(opts.caBundleFile)
+	if err != nil {
+		return err
+	}
+	out, err := yaml.Marshal(mutatingWebhookConfiguration(opts, caBundle))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// readCABundle reads a PEM bundle for the caBundle of the webhook
+// configuration
+func readCABundle(path string) ([]byte, error) {
+	caBundle, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading caBundle: %v", err)
+	}
+	if block, _ := pem.Decode(caBundle); block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s does not contain a PEM encoded certificate", path)
+	}
+	return caBundle, nil
+}
+
+func appLabels() map[string]string {
+	return map[string]string{"app": appName}
+}
+
+func webhookDeployment(opts manifestOptions) *appsv1.Deployment {
+	replicas := int32(1)
+	return &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      appName + "-deployment",
+			Namespace: opts.namespace,
+			Labels:    appLabels(),
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: appLabels()},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: appLabels()},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:  appName,
+						Image: opts.image,
+						Args: []string{
+							fmt.Sprintf("-port=%d", opts.port),
+							"-tlsCertFile=" + certMountPath + "/cert.pem",
+							"-tlsKeyFile=" + certMountPath + "/key.pem",
+							"-annotationCfgFile=" + configMountPath + "/default-annotations.json",
+							"-alsologtostderr",
+							"-v=4",
+						},
+						ReadinessProbe: &corev1.Probe{
+							Handler: corev1.Handler{
+								HTTPGet: &corev1.HTTPGetAction{
+									Path:   "/readyz",
+									Port:   intstr.FromInt(opts.port),
+									Scheme: corev1.URISchemeHTTPS,
+								},
+							},
+						},
+						VolumeMounts: []corev1.VolumeMount{
+							{Name: "webhook-certs", MountPath: certMountPath, ReadOnly: true},
+							{Name: configMapName, MountPath: configMountPath, ReadOnly: true},
+						},
+					}},
+					Volumes: []corev1.Volume{
+						{
+							Name: "webhook-certs",
+							VolumeSource: corev1.VolumeSource{
+								Secret: &corev1.SecretVolumeSource{SecretName: certSecretName},
+							},
+						},
+						{
+							Name: configMapName,
+							VolumeSource: corev1.VolumeSource{
+								ConfigMap: &corev1.ConfigMapVolumeSource{
+									LocalObjectReference: corev1.LocalObjectReference{Name: configMapName},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func webhookService(opts manifestOptions) *corev1.Service {
+	return &corev1.Service{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      opts.serviceName,
+			Namespace: opts.namespace,
+			Labels:    appLabels(),
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{
+				Port:       443,
+				TargetPort: intstr.FromInt(opts.port),
+			}},
+			Selector: appLabels(),
+		},
+	}
+}
+
+func mutatingWebhookConfiguration(opts manifestOptions, caBundle []byte) *admissionregistrationv1beta1.MutatingWebhookConfiguration {
+	path := opts.webhookPath
+	if path == "" {
+		path = "/mutate"
+	}
+	var failurePolicy *admissionregistrationv1beta1.FailurePolicyType
+	if opts.failurePolicy != "" {
+		policy := admissionregistrationv1beta1.FailurePolicyType(opts.failurePolicy)
+		failurePolicy = &policy
+	}
+	return &admissionregistrationv1beta1.MutatingWebhookConfiguration{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admissionregistration.k8s.io/v1beta1", Kind: "MutatingWebhookConfiguration"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "mutating-webhook-example-cfg",
+			Labels: appLabels(),
+		},
+		Webhooks: []admissionregistrationv1beta1.MutatingWebhook{{
+			Name: "mutating-example.banzaicloud.com",
+			ClientConfig: admissionregistrationv1beta1.WebhookClientConfig{
+				Service: &admissionregistrationv1beta1.ServiceReference{
+					Name:      opts.serviceName,
+					Namespace: opts.namespace,
+					Path:      &path,
+				},
+				CABundle: caBundle,
+			},
+			FailurePolicy: failurePolicy,
+			Rules: []admissionregistrationv1beta1.RuleWithOperations{{
+				Operations: []admissionregistrationv1beta1.OperationType{
+					admissionregistrationv1beta1.Create,
+					admissionregistrationv1beta1.Update,
+				},
+				Rule: admissionregistrationv1beta1.Rule{
+					APIGroups:   []string{"*"},
+					APIVersions: []string{"*"},
+					Resources:   []string{"ingresses", "services"},
+				},
+			}},
+		}},
+	}
+}
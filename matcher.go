@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Matcher is a single condition a config entry puts on the objects it applies
+// to. An entry applies when all of its matchers match.
+type Matcher interface {
+	Matches(obj *admissionObject) bool
+	// String describes the condition in logs
+	String() string
+}
+
+// matchers returns the conditions of the entry: first those on the object
+// alone, then those on the request made for it, which can't be evaluated
+// against objects already in the cluster
+func (c *annotationConfig) matchers() (object, request []Matcher) {
+	if c.Namespace != "" {
+		object = append(object, namespaceMatcher(c.Namespace))
+	}
+	if c.namespaceSelector != nil {
+		object = append(object, &namespaceSelectorMatcher{selector: c.namespaceSelector})
+	}
+	if c.nameRegex != nil {
+		object = append(object, &nameRegexMatcher{regex: c.nameRegex, pattern: c.IngressNameRegex})
+	}
+	if c.OptInAnnotation != "" {
+		object = append(object, &annotationMatcher{key: c.OptInAnnotation, value: c.OptInValue})
+	}
+	if c.MatchAnnotation != nil {
+		object = append(object, &annotationValueMatcher{condition: *c.MatchAnnotation, regex: c.matchAnnotationRegex})
+	}
+	if c.MatchLabelKey != "" {
+		object = append(object, &labelMatcher{key: c.MatchLabelKey, value: c.MatchLabelValue})
+	}
+	if c.MatchOwnerKind != "" {
+		object = append(object, &ownerMatcher{kind: c.MatchOwnerKind, apiVersion: c.MatchOwnerAPIVersion})
+	}
+	if c.HasTLS != nil {
+		object = append(object, tlsMatcher(*c.HasTLS))
+	}
+	if c.IngressClass != "" {
+		object = append(object, ingressClassMatcher(c.IngressClass))
+	}
+	if c.ClassUnset {
+		object = append(object, classUnsetMatcher{})
+	}
+	if c.HostSuffix != "" {
+		object = append(object, hostSuffixMatcher(strings.ToLower(c.HostSuffix)))
+	}
+	if !c.activeFrom.IsZero() || !c.activeUntil.IsZero() {
+		object = append(object, &activeMatcher{from: c.activeFrom, until: c.activeUntil})
+	}
+	if len(c.Operations) > 0 {
+		request = append(request, operationMatcher(c.Operations))
+	}
+	if len(c.MatchUsers) > 0 || len(c.MatchGroups) > 0 {
+		request = append(request, &userMatcher{users: c.MatchUsers, groups: c.MatchGroups})
+	}
+	return object, request
+}
+
+// firstMismatch returns the first of matchers that doesn't match obj, or nil
+func firstMismatch(matchers []Matcher, obj *admissionObject) Matcher {
+	for _, m := range matchers {
+		if !m.Matches(obj) {
+			return m
+		}
+	}
+	return nil
+}
+
+// namespaceMatcher matches objects in the namespace
+type namespaceMatcher string
+
+func (m namespaceMatcher) Matches(obj *admissionObject) bool {
+	return obj.metadata.Namespace == string(m)
+}
+
+func (m namespaceMatcher) String() string {
+	return "namespace " + string(m)
+}
+
+// namespaceSelectorMatcher matches objects in namespaces whose labels match
+// the selector. Nothing matches when the labels couldn't be read.
+type namespaceSelectorMatcher struct {
+	selector labels.Selector
+}
+
+func (m *namespaceSelectorMatcher) Matches(obj *admissionObject) bool {
+	return obj.namespaceLabels != nil && m.selector.Matches(obj.namespaceLabels)
+}
+
+func (m *namespaceSelectorMatcher) String() string {
+	return fmt.Sprintf("namespace labels %q", m.selector.String())
+}
+
+// nameRegexMatcher matches objects whose whole name matches the expression
+type nameRegexMatcher struct {
+	regex   *regexp.Regexp
+	pattern string // as written in the config
+}
+
+func (m *nameRegexMatcher) Matches(obj *admissionObject) bool {
+	return m.regex.MatchString(obj.metadata.Name)
+}
+
+func (m *nameRegexMatcher) String() string {
+	return fmt.Sprintf("name matching %q", m.pattern)
+}
+
+// annotationMatcher matches objects carrying the annotation, with the value if
+// one is given
+type annotationMatcher struct {
+	key, value string
+}
+
+func (m *annotationMatcher) Matches(obj *admissionObject) bool {
+	return matchesKeyValue(obj.metadata.Annotations, m.key, m.value)
+}
+
+func (m *annotationMatcher) String() string {
+	return describeKeyValue("annotation", m.key, m.value)
+}
+
+// annotationValueMatcher matches objects whose annotation satisfies the
+// condition
+type annotationValueMatcher struct {
+	condition annotationCondition
+	regex     *regexp.Regexp // condition.ValueRegex anchored, nil without one
+}
+
+func (m *annotationValueMatcher) Matches(obj *admissionObject) bool {
+	value, ok := obj.metadata.Annotations[m.condition.Key]
+	if !ok {
+		return false
+	}
+	if m.regex != nil {
+		return m.regex.MatchString(value)
+	}
+	return m.condition.Value == "" || value == m.condition.Value
+}
+
+func (m *annotationValueMatcher) String() string {
+	if m.regex != nil {
+		return "annotation " + m.condition.Key + "~" + m.condition.ValueRegex
+	}
+	return describeKeyValue("annotation", m.condition.Key, m.condition.Value)
+}
+
+// labelMatcher matches objects carrying the label, with the value if one is
+// given
+type labelMatcher struct {
+	key, value string
+}
+
+func (m *labelMatcher) Matches(obj *admissionObject) bool {
+	return matchesKeyValue(obj.metadata.Labels, m.key, m.value)
+}
+
+func (m *labelMatcher) String() string {
+	return describeKeyValue("label", m.key, m.value)
+}
+
+// ownerMatcher matches objects with an owner reference of the kind, with the
+// apiVersion if one is given
+type ownerMatcher struct {
+	kind, apiVersion string
+}
+
+func (m *ownerMatcher) Matches(obj *admissionObject) bool {
+	for _, owner := range obj.metadata.OwnerReferences {
+		if owner.Kind == m.kind && (m.apiVersion == "" || owner.APIVersion == m.apiVersion) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *ownerMatcher) String() string {
+	if m.apiVersion == "" {
+		return "owned by a " + m.kind
+	}
+	return "owned by a " + m.apiVersion + " " + m.kind
+}
+
+func matchesKeyValue(values map[string]string, key, value string) bool {
+	current, ok := values[key]
+	return ok && (value == "" || current == value)
+}
+
+func describeKeyValue(what, key, value string) string {
+	if value == "" {
+		return what + " " + key
+	}
+	return what + " " + key + "=" + value
+}
+
+// tlsMatcher matches ingresses with (true) or without (false) spec.tls
+type tlsMatcher bool
+
+func (m tlsMatcher) Matches(obj *admissionObject) bool {
+	return obj.hasTLS == bool(m)
+}
+
+func (m tlsMatcher) String() string {
+	return fmt.Sprintf("hasTLS=%v", bool(m))
+}
+
+// ingressClassMatcher matches ingresses of the class
+type ingressClassMatcher string
+
+func (m ingressClassMatcher) Matches(obj *admissionObject) bool {
+	return obj.ingressClass == string(m)
+}
+
+func (m ingressClassMatcher) String() string {
+	return "ingress class " + string(m)
+}
+
+// classUnsetMatcher matches ingresses that haven't picked a class
+type classUnsetMatcher struct{}
+
+func (classUnsetMatcher) Matches(obj *admissionObject) bool {
+	return obj.ingressClass == ""
+}
+
+func (classUnsetMatcher) String() string {
+	return "no ingress class"
+}
+
+// hostSuffixMatcher matches ingresses with any rule host in the domain. A
+// suffix starting with "*." or "." only matches hosts below the domain, one
+// without also the domain itself.
+type hostSuffixMatcher string
+
+func (m hostSuffixMatcher) Matches(obj *admissionObject) bool {
+	suffix := strings.TrimPrefix(string(m), "*")
+	for _, host := range obj.hosts {
+		host = strings.ToLower(host)
+		if strings.HasPrefix(suffix, ".") {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m hostSuffixMatcher) String() string {
+	return "host in " + string(m)
+}
+
+// activeMatcher matches from the time from, if set, until the time until, if
+// set
+type activeMatcher struct {
+	from, until time.Time
+}
+
+func (m *activeMatcher) Matches(obj *admissionObject) bool {
+	now := time.Now()
+	return (m.from.IsZero() || !now.Before(m.from)) && (m.until.IsZero() || now.Before(m.until))
+}
+
+func (m *activeMatcher) String() string {
+	switch {
+	case m.from.IsZero():
+		return "time before " + m.until.Format(time.RFC3339)
+	case m.until.IsZero():
+		return "time from " + m.from.Format(time.RFC3339)
+	}
+	return "time from " + m.from.Format(time.RFC3339) + " until " + m.until.Format(time.RFC3339)
+}
+
+// operationMatcher matches requests made for one of the operations
+type operationMatcher []string
+
+func (m operationMatcher) Matches(obj *admissionObject) bool {
+	for _, op := range m {
+		if op == string(obj.operation) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m operationMatcher) String() string {
+	return "operation " + strings.Join(m, " or ")
+}
+
+// userMatcher matches requests made by one of the users or by a member of one
+// of the groups
+type userMatcher struct {
+	users, groups []string
+}
+
+func (m *userMatcher) Matches(obj *admissionObject) bool {
+	for _, user := range m.users {
+		if user == obj.userInfo.Username {
+			return true
+		}
+	}
+	for _, group := range m.groups {
+		for _, userGroup := range obj.userInfo.Groups {
+			if group == userGroup {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m *userMatcher) String() string {
+	return fmt.Sprintf("user in %v or group in %v", m.users, m.groups)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestMatchHasTLS(t *testing.T) {
+	whsvr := newTestServer(t, `[
+		{"ingressName": "*", "hasTLS": true, "defaultAnnotations": {"ingress.citrix.com/secure-port": "443"}},
+		{"ingressName": "*", "hasTLS": false, "defaultAnnotations": {"ingress.citrix.com/insecure-termination": "allow"}},
+		{"ingressName": "*", "defaultAnnotations": {"any": "1"}}
+	]`)
+	tls := testIngress("default", "secure", nil)
+	tls.Spec.TLS = []networkingv1beta1.IngressTLS{{Hosts: []string{"secure.example.com"}, SecretName: "cert"}}
+	tests := []struct {
+		name    string
+		ingress *networkingv1beta1.Ingress
+		want    map[string]string
+	}{
+		{"tls", tls, map[string]string{"ingress.citrix.com/secure-port": "443", "any": "1"}},
+		{"plain http", testIngress("default", "plain", nil), map[string]string{"ingress.citrix.com/insecure-termination": "allow", "any": "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mutatedAnnotations(t, whsvr, ingressReview(t, tt.ingress)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("annotations = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchIngressNameRegex(t *testing.T) {
+	whsvr := newTestServer(t, `[
+		{"ingressName": "prod-eu-web", "defaultAnnotations": {"timeout": "60"}},
+		{"ingressNameRegex": "prod-.*-(web|api)", "defaultAnnotations": {"timeout": "30", "tier": "prod"}},
+		{"ingressName": "*", "defaultAnnotations": {"timeout": "10"}}
+	]`)
+	tests := []struct {
+		name string
+		want map[string]string
+	}{
+		{"prod-us-api", map[string]string{"timeout": "30", "tier": "prod"}},
+		{"prod-eu-web", map[string]string{"timeout": "60", "tier": "prod"}},
+		{"prod-us-db", map[string]string{"timeout": "10"}},
+		// the pattern is anchored at both ends
+		{"xprod-us-api", map[string]string{"timeout": "10"}},
+		{"prod-us-apis", map[string]string{"timeout": "10"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mutatedAnnotations(t, whsvr, ingressReview(t, testIngress("default", tt.name, nil))); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("annotations = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchers(t *testing.T) {
+	obj := &admissionObject{
+		kind: kindIngress,
+		metadata: &metav1.ObjectMeta{
+			Namespace:       "team-a",
+			Name:            "prod-web",
+			Annotations:     map[string]string{"tier": "gold"},
+			Labels:          map[string]string{"app": "web"},
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: "web"}},
+		},
+		operation:       v1beta1.Create,
+		userInfo:        authenticationv1.UserInfo{Username: "alice", Groups: []string{"devs"}},
+		hosts:           []string{"Web.Example.com"},
+		hasTLS:          true,
+		ingressClass:    "citrix",
+		namespaceLabels: labels.Set{"team": "a"},
+	}
+	unread := *obj
+	unread.namespaceLabels = nil
+	unclassed := *obj
+	unclassed.ingressClass = ""
+	hour := time.Hour
+	now := time.Now()
+	tests := []struct {
+		name    string
+		matcher Matcher
+		obj     *admissionObject
+		want    bool
+	}{
+		{"namespace", namespaceMatcher("team-a"), obj, true},
+		{"other namespace", namespaceMatcher("team-b"), obj, false},
+		{"namespace labels", &namespaceSelectorMatcher{selector: labels.SelectorFromSet(labels.Set{"team": "a"})}, obj, true},
+		{"other namespace labels", &namespaceSelectorMatcher{selector: labels.SelectorFromSet(labels.Set{"team": "b"})}, obj, false},
+		{"namespace labels unread", &namespaceSelectorMatcher{selector: labels.Everything()}, &unread, false},
+		{"name regex", &nameRegexMatcher{regex: regexp.MustCompile("^(?:prod-.*)$")}, obj, true},
+		{"name regex mismatch", &nameRegexMatcher{regex: regexp.MustCompile("^(?:dev-.*)$")}, obj, false},
+		{"annotation", &annotationMatcher{key: "tier"}, obj, true},
+		{"annotation value", &annotationMatcher{key: "tier", value: "gold"}, obj, true},
+		{"annotation other value", &annotationMatcher{key: "tier", value: "silver"}, obj, false},
+		{"annotation missing", &annotationMatcher{key: "owner"}, obj, false},
+		{"annotation condition", &annotationValueMatcher{condition: annotationCondition{Key: "tier", Value: "gold"}}, obj, true},
+		{"annotation condition key only", &annotationValueMatcher{condition: annotationCondition{Key: "tier"}}, obj, true},
+		{"annotation condition regex", &annotationValueMatcher{condition: annotationCondition{Key: "tier", ValueRegex: "g.*"}, regex: regexp.MustCompile("^(?:g.*)$")}, obj, true},
+		{"annotation condition regex mismatch", &annotationValueMatcher{condition: annotationCondition{Key: "tier", ValueRegex: "s.*"}, regex: regexp.MustCompile("^(?:s.*)$")}, obj, false},
+		{"label", &labelMatcher{key: "app", value: "web"}, obj, true},
+		{"label other value", &labelMatcher{key: "app", value: "api"}, obj, false},
+		{"owner kind", &ownerMatcher{kind: "Deployment"}, obj, true},
+		{"owner kind and apiVersion", &ownerMatcher{kind: "Deployment", apiVersion: "apps/v1"}, obj, true},
+		{"owner other apiVersion", &ownerMatcher{kind: "Deployment", apiVersion: "extensions/v1beta1"}, obj, false},
+		{"owner other kind", &ownerMatcher{kind: "StatefulSet"}, obj, false},
+		{"tls", tlsMatcher(true), obj, true},
+		{"no tls", tlsMatcher(false), obj, false},
+		{"ingress class", ingressClassMatcher("citrix"), obj, true},
+		{"other ingress class", ingressClassMatcher("nginx"), obj, false},
+		{"class unset", classUnsetMatcher{}, &unclassed, true},
+		{"class set", classUnsetMatcher{}, obj, false},
+		{"host in domain", hostSuffixMatcher("example.com"), obj, true},
+		{"host is the domain", hostSuffixMatcher("web.example.com"), obj, true},
+		{"wildcard excludes the domain", hostSuffixMatcher("*.web.example.com"), obj, false},
+		{"wildcard", hostSuffixMatcher("*.example.com"), obj, true},
+		{"host in other domain", hostSuffixMatcher("example.org"), obj, false},
+		{"active", &activeMatcher{from: now.Add(-hour), until: now.Add(hour)}, obj, true},
+		{"not active yet", &activeMatcher{from: now.Add(hour)}, obj, false},
+		{"no longer active", &activeMatcher{until: now.Add(-hour)}, obj, false},
+		{"operation", operationMatcher{"UPDATE", "CREATE"}, obj, true},
+		{"other operation", operationMatcher{"UPDATE"}, obj, false},
+		{"user", &userMatcher{users: []string{"alice"}}, obj, true},
+		{"group", &userMatcher{groups: []string{"devs"}}, obj, true},
+		{"other user and group", &userMatcher{users: []string{"bob"}, groups: []string{"ops"}}, obj, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.matcher.Matches(tt.obj); got != tt.want {
+				t.Errorf("%v: Matches = %v, want %v", tt.matcher, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFirstMismatch(t *testing.T) {
+	obj := &admissionObject{metadata: &metav1.ObjectMeta{Namespace: "team-a"}, hasTLS: true}
+	mismatch := namespaceMatcher("team-b")
+	if m := firstMismatch([]Matcher{tlsMatcher(true), mismatch, tlsMatcher(false)}, obj); m != mismatch {
+		t.Errorf("first mismatch = %v, want %v", m, mismatch)
+	}
+	if m := firstMismatch([]Matcher{tlsMatcher(true), namespaceMatcher("team-a")}, obj); m != nil {
+		t.Errorf("first mismatch = %v, want none", m)
+	}
+}
+
+func TestMatchEnabled(t *testing.T) {
+	// the last entry stages a change of the enabled one, it's no duplicate
+	whsvr := newTestServer(t, `[
+		{"ingressName": "staged", "enabled": false, "defaultAnnotations": {"a": "1"}},
+		{"ingressName": "live", "enabled": true, "defaultAnnotations": {"a": "1"}},
+		{"ingressName": "default", "defaultAnnotations": {"a": "1"}},
+		{"ingressName": "live", "enabled": false, "defaultAnnotations": {"a": "2"}}
+	]`)
+	for name, want := range map[string]string{"staged": "", "live": "1", "default": "1"} {
+		if got := mutatedAnnotations(t, whsvr, ingressReview(t, testIngress("default", name, nil)))["a"]; got != want {
+			t.Errorf("%s: a = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestMatchHostSuffix(t *testing.T) {
+	whsvr := newTestServer(t, `[{"ingressName": "*", "hostSuffix": "*.Internal.example.com", "defaultAnnotations": {"internal": "true"}}]`)
+	tests := []struct {
+		name  string
+		hosts []string
+		want  bool
+	}{
+		{"below the domain", []string{"app.internal.example.com"}, true},
+		{"any of several hosts", []string{"www.example.com", "APP.internal.example.com"}, true},
+		{"the domain itself", []string{"internal.example.com"}, false},
+		{"suffix of a label", []string{"app.notinternal.example.com"}, false},
+		{"no hosts", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ingress := testIngress("default", "web", nil)
+			for _, host := range tt.hosts {
+				ingress.Spec.Rules = append(ingress.Spec.Rules, networkingv1beta1.IngressRule{Host: host})
+			}
+			if got := mutatedAnnotations(t, whsvr, ingressReview(t, ingress))["internal"] == "true"; got != tt.want {
+				t.Errorf("matched = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchActiveWindow(t *testing.T) {
+	now := time.Now().UTC()
+	at := func(d time.Duration) string {
+		return now.Add(d).Format(time.RFC3339)
+	}
+	tests := []struct {
+		name   string
+		window string
+		want   bool
+	}{
+		{"past", fmt.Sprintf(`"activeFrom": %q, "activeUntil": %q`, at(-2*time.Hour), at(-time.Hour)), false},
+		{"current", fmt.Sprintf(`"activeFrom": %q, "activeUntil": %q`, at(-time.Hour), at(time.Hour)), true},
+		{"future", fmt.Sprintf(`"activeFrom": %q, "activeUntil": %q`, at(time.Hour), at(2*time.Hour)), false},
+		{"started", fmt.Sprintf(`"activeFrom": %q`, at(-time.Hour)), true},
+		{"expired", fmt.Sprintf(`"activeUntil": %q`, at(-time.Hour)), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			whsvr := newTestServer(t, `[{"ingressName": "web", `+tt.window+`, "defaultAnnotations": {"a": "1"}}]`)
+			if got := mutatePatch(t, whsvr, ingressReview(t, testIngress("default", "web", nil))) != ""; got != tt.want {
+				t.Errorf("patched = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchClassUnset(t *testing.T) {
+	whsvr := newTestServer(t, `[{"ingressName": "*", "classUnset": true, "defaultAnnotations": {"migrate": "citrix"}}]`)
+	citrix := "citrix"
+	empty := ""
+	withClassName := func(name *string) *networkingv1beta1.Ingress {
+		ingress := testIngress("default", "web", nil)
+		ingress.Spec.IngressClassName = name
+		return ingress
+	}
+	tests := []struct {
+		name    string
+		ingress *networkingv1beta1.Ingress
+		want    bool
+	}{
+		{"no class", testIngress("default", "web", nil), true},
+		{"empty ingressClassName", withClassName(&empty), true},
+		{"ingressClassName", withClassName(&citrix), false},
+		{"legacy annotation", testIngress("default", "web", map[string]string{ingressClassAnnotation: "citrix"}), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mutatedAnnotations(t, whsvr, ingressReview(t, tt.ingress))["migrate"] == "citrix"; got != tt.want {
+				t.Errorf("matched = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchAnnotation(t *testing.T) {
+	whsvr := newTestServer(t, `[
+		{"ingressName": "*", "matchAnnotation": {"key": "argocd.argoproj.io/instance", "value": "shop"}, "defaultAnnotations": {"app": "shop"}},
+		{"ingressName": "*", "matchAnnotation": {"key": "argocd.argoproj.io/instance", "valueRegex": "team-.*"}, "defaultAnnotations": {"app": "team"}},
+		{"ingressName": "*", "matchAnnotation": {"key": "example.com/managed"}, "defaultAnnotations": {"managed": "true"}}
+	]`)
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		app         string
+		managed     bool
+	}{
+		{"value", map[string]string{"argocd.argoproj.io/instance": "shop"}, "shop", false},
+		{"value regex", map[string]string{"argocd.argoproj.io/instance": "team-a"}, "team", false},
+		{"regex is anchored", map[string]string{"argocd.argoproj.io/instance": "my-team-a"}, "", false},
+		{"key only", map[string]string{"example.com/managed": ""}, "", true},
+		{"no annotation", nil, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ar := ingressReview(t, testIngress("default", "web", tt.annotations))
+			annotations := mutatedAnnotations(t, whsvr, ar)
+			if annotations["app"] != tt.app || (annotations["managed"] == "true") != tt.managed {
+				t.Errorf("annotations = %v, want app %q and managed %v", annotations, tt.app, tt.managed)
+			}
+		})
+	}
+}
+
+func TestMatchOwner(t *testing.T) {
+	whsvr := newTestServer(t, `[
+		{"ingressName": "*", "matchOwnerKind": "AppRelease", "matchOwnerAPIVersion": "apps.example.com/v1", "defaultAnnotations": {"generated": "true"}},
+		{"ingressName": "*", "matchOwnerKind": "Deployment", "defaultAnnotations": {"deployment": "true"}}
+	]`)
+	owned := func(owners ...metav1.OwnerReference) *networkingv1beta1.Ingress {
+		ingress := testIngress("default", "web", nil)
+		ingress.OwnerReferences = owners
+		return ingress
+	}
+	release := metav1.OwnerReference{APIVersion: "apps.example.com/v1", Kind: "AppRelease", Name: "shop", UID: "1"}
+	oldRelease := metav1.OwnerReference{APIVersion: "apps.example.com/v1alpha1", Kind: "AppRelease", Name: "shop", UID: "1"}
+	deployment := metav1.OwnerReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "shop", UID: "2"}
+	tests := []struct {
+		name    string
+		ingress *networkingv1beta1.Ingress
+		want    map[string]string
+	}{
+		{"no owner", owned(), nil},
+		{"kind and apiVersion", owned(release), map[string]string{"generated": "true"}},
+		{"other apiVersion", owned(oldRelease), nil},
+		{"kind only", owned(deployment), map[string]string{"deployment": "true"}},
+		{"several owners", owned(deployment, release), map[string]string{"generated": "true", "deployment": "true"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mutatedAnnotations(t, whsvr, ingressReview(t, tt.ingress)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("annotations = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "admission_webhook"
+
+var (
+	validationWouldReject = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "validation_would_reject_total",
+		Help:      "Requests that validation would have rejected while running with -validateShadow.",
+	})
+	configReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_reloads_total",
+		Help:      "Configuration reloads on SIGHUP, by result: success or failure.",
+	}, []string{"result"})
+	configEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_entries",
+		Help:      "Default annotation entries in the configuration in use.",
+	})
+	configLastReload = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_last_reload_timestamp_seconds",
+		Help:      "Unix time the configuration in use was loaded.",
+	})
+	decisionSinkDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "decision_sink_dropped_total",
+		Help:      "Decisions not sent to -decisionSink because its queue was full.",
+	})
+	webhookPaused = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "paused",
+		Help:      "1 while the webhook is paused by the policy file or -pauseConfigMap, 0 otherwise.",
+	})
+	configOrphanedEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_orphaned_entries",
+		Help:      "Config entries naming ingresses that none of the existing ingresses has, by the last -orphanCheckInterval check.",
+	})
+	responseCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "response_cache_hits_total",
+		Help:      "Retried requests answered from the -responseCacheSize cache.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(validationWouldReject, configReloads, configEntries, configLastReload, decisionSinkDropped, webhookPaused, configOrphanedEntries, responseCacheHits)
+	// both results are exported from the start, so failures can be alerted on
+	configReloads.WithLabelValues("success")
+	configReloads.WithLabelValues("failure")
+}
+
+// configInUse updates the configuration metrics for newly loaded entries
+func configInUse(entries []annotationConfig) {
+	configEntries.Set(float64(len(entries)))
+	configLastReload.SetToCurrentTime()
+}
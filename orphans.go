@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// orphanedEntries returns the ingress entries naming ingresses, by
+// ingressName or ingressNameRegex, that none of ingresses has, sorted by
+// description. Catch-all entries always have something to apply to, and
+// conditions other than the name and namespace are not looked at. With
+// watchNamespace set, entries for other namespaces are left out since their
+// ingresses aren't listed.
+func orphanedEntries(index annotationIndex, ingresses []*networkingv1beta1.Ingress, caseSensitive bool, watchNamespace string) []*annotationConfig {
+	used := map[*annotationConfig]bool{}
+	regexEntries := index[regexIndexKey(kindIngress)]
+	for _, ingress := range ingresses {
+		candidates := append(regexEntries[:len(regexEntries):len(regexEntries)], index[indexKey(kindIngress, ingress.Name)]...)
+		for _, dflt := range candidates {
+			if used[dflt] || (caseSensitive && !dflt.namesExactly(ingress.Name)) {
+				continue
+			}
+			if dflt.Namespace != "" && dflt.Namespace != ingress.Namespace {
+				continue
+			}
+			if dflt.nameRegex != nil && !dflt.nameRegex.MatchString(ingress.Name) {
+				continue
+			}
+			used[dflt] = true
+		}
+	}
+	var orphaned []*annotationConfig
+	for key, entries := range index {
+		if key == indexKey(kindIngress, wildcardIngressName) {
+			continue
+		}
+		for _, dflt := range entries {
+			if dflt.kind() != kindIngress || used[dflt] {
+				continue
+			}
+			if watchNamespace != "" && dflt.Namespace != "" && dflt.Namespace != watchNamespace {
+				continue
+			}
+			orphaned = append(orphaned, dflt)
+		}
+	}
+	sort.Slice(orphaned, func(i, j int) bool {
+		return orphaned[i].describe() < orphaned[j].describe()
+	})
+	return orphaned
+}
+
+// checkOrphanedEntries warns about the entries that match no existing
+// ingress and exports how many there are
+func (whsvr *WebhookServer) checkOrphanedEntries() {
+	ctx := context.Background()
+	if whsvr.listerTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, whsvr.listerTimeout)
+		defer cancel()
+	}
+	ingresses, err := whsvr.ingressLister.List(ctx)
+	if err != nil {
+		glog.Errorf("Can't list ingresses to look for stale config entries: %v", err)
+		return
+	}
+	orphaned := orphanedEntries(whsvr.annotationConfigIndex(), ingresses, whsvr.caseSensitiveMatch, whsvr.watchNamespace)
+	for _, dflt := range orphaned {
+		glog.Warningf("Config entry %s matches no existing ingress, it may be stale", dflt.describe())
+	}
+	configOrphanedEntries.Set(float64(len(orphaned)))
+}
+
+// watchOrphanedEntries checks for stale entries every interval and after
+// every reload, until stopCh is closed
+func (whsvr *WebhookServer) watchOrphanedEntries(interval time.Duration, stopCh <-chan struct{}) {
+	if !cache.WaitForCacheSync(stopCh, whsvr.ingressLister.HasSynced) {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		whsvr.checkOrphanedEntries()
+		select {
+		case <-ticker.C:
+		case <-whsvr.orphanCheck:
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// requestOrphanCheck has the stale entries checked again soon. Requests made
+// while a check is pending are merged into it.
+func (whsvr *WebhookServer) requestOrphanCheck() {
+	if whsvr.orphanCheck == nil {
+		return
+	}
+	select {
+	case whsvr.orphanCheck <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/golang/glog"
+)
+
+// logPatchedAnnotations logs, at -v=5 and above, the annotations the object
+// ends up with once the API server applies patch
+func logPatchedAnnotations(raw, patch []byte, namespace, name string) {
+	if !glog.V(5) {
+		return
+	}
+	ops, err := jsonpatch.DecodePatch(patch)
+	if err != nil {
+		glog.Errorf("Could not decode the patch for %s/%s: %v", namespace, name, err)
+		return
+	}
+	patched, err := ops.Apply(raw)
+	if err != nil {
+		glog.Errorf("Could not apply the patch for %s/%s: %v", namespace, name, err)
+		return
+	}
+	var object struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(patched, &object); err != nil {
+		glog.Errorf("Could not decode the patched %s/%s: %v", namespace, name, err)
+		return
+	}
+	glog.Infof("Annotations of %s/%s after the patch: %v", namespace, name, object.Metadata.Annotations)
+}
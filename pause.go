@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// pauseKey is the ConfigMap key that pauses the webhook when "true"
+const pauseKey = "paused"
+
+// pauseConfigMap follows the pauseKey of a ConfigMap, a kill switch that
+// takes effect without a reload. A nil *pauseConfigMap is never paused.
+type pauseConfigMap struct {
+	namespace, name string
+	// called after every change of the state
+	onChange func()
+
+	mu     sync.RWMutex
+	paused bool
+}
+
+// watchPauseConfigMap starts watching the ConfigMap until stopCh is closed.
+// Until it has been read, and while it doesn't exist, the webhook isn't
+// paused.
+func watchPauseConfigMap(client kubernetes.Interface, namespace, name string, onChange func(), stopCh <-chan struct{}) *pauseConfigMap {
+	p := &pauseConfigMap{namespace: namespace, name: name, onChange: onChange}
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}))
+	informer := factory.Core().V1().ConfigMaps().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    p.onConfigMap,
+		UpdateFunc: func(_, obj interface{}) { p.onConfigMap(obj) },
+		DeleteFunc: func(interface{}) { p.set(false) },
+	})
+	factory.Start(stopCh)
+	return p
+}
+
+func (p *pauseConfigMap) onConfigMap(obj interface{}) {
+	configMap, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		return
+	}
+	p.set(strings.EqualFold(configMap.Data[pauseKey], "true"))
+}
+
+func (p *pauseConfigMap) set(paused bool) {
+	p.mu.Lock()
+	changed := p.paused != paused
+	p.paused = paused
+	p.mu.Unlock()
+	if !changed {
+		return
+	}
+	if paused {
+		glog.Warningf("Paused by %s in ConfigMap %s/%s, allowing every request untouched", pauseKey, p.namespace, p.name)
+	} else {
+		glog.Infof("Unpaused by ConfigMap %s/%s", p.namespace, p.name)
+	}
+	p.onChange()
+}
+
+func (p *pauseConfigMap) isPaused() bool {
+	if p == nil {
+		return false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.paused
+}
+
+// paused reports whether the policy file or the pause ConfigMap pause the
+// webhook
+func (whsvr *WebhookServer) paused() bool {
+	return whsvr.currentPolicy().Paused || whsvr.pauseConfigMap.isPaused()
+}
+
+// updatePausedMetric exports the current state in the paused gauge
+func (whsvr *WebhookServer) updatePausedMetric() {
+	if whsvr.paused() {
+		webhookPaused.Set(1)
+	} else {
+		webhookPaused.Set(0)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestPauseConfigMap(t *testing.T) {
+	changes := 0
+	p := &pauseConfigMap{namespace: "ops", name: "webhook", onChange: func() { changes++ }}
+	steps := []struct {
+		name    string
+		apply   func()
+		paused  bool
+		changes int
+	}{
+		{"paused", func() { p.onConfigMap(&corev1.ConfigMap{Data: map[string]string{pauseKey: "True"}}) }, true, 1},
+		{"still paused", func() { p.onConfigMap(&corev1.ConfigMap{Data: map[string]string{pauseKey: "true", "other": "x"}}) }, true, 1},
+		{"unpaused", func() { p.onConfigMap(&corev1.ConfigMap{Data: map[string]string{pauseKey: "false"}}) }, false, 2},
+		{"key missing", func() { p.onConfigMap(&corev1.ConfigMap{}) }, false, 2},
+		{"paused again", func() { p.onConfigMap(&corev1.ConfigMap{Data: map[string]string{pauseKey: "true"}}) }, true, 3},
+		{"not a ConfigMap", func() { p.onConfigMap("garbage") }, true, 3},
+		// what the informer does when the ConfigMap is deleted
+		{"deleted", func() { p.set(false) }, false, 4},
+	}
+	for _, step := range steps {
+		step.apply()
+		if p.isPaused() != step.paused || changes != step.changes {
+			t.Errorf("%s: paused %v after %d changes, want %v after %d", step.name, p.isPaused(), changes, step.paused, step.changes)
+		}
+	}
+	if (*pauseConfigMap)(nil).isPaused() {
+		t.Error("nil pauseConfigMap is paused")
+	}
+}
+
+func TestPausedAdmission(t *testing.T) {
+	body, err := json.Marshal(ingressReview(t, testIngress("default", "web", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		pause func(*WebhookServer)
+	}{
+		{"policy file", func(w *WebhookServer) { w.policy.Paused = true }},
+		{"ConfigMap", func(w *WebhookServer) { w.pauseConfigMap = &pauseConfigMap{paused: true} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			whsvr := newTestServer(t, `[{"ingressName": "*", "defaultAnnotations": {"a": "1"}}]`)
+			// would reject every ingress it looked at
+			whsvr.policy = policyConfig{Lockdown: true}
+			tt.pause(whsvr)
+			for _, path := range []string{"/mutate", "/validate"} {
+				resp := whsvr.handleAdmission(context.Background(), path, body).Response
+				if !resp.Allowed || resp.Patch != nil || resp.Result != nil {
+					t.Errorf("%s answered %+v, want a plain allow", path, resp)
+				}
+			}
+			whsvr.updatePausedMetric()
+			if v := testutil.ToFloat64(webhookPaused); v != 1 {
+				t.Errorf("webhook_paused = %v, want 1", v)
+			}
+		})
+	}
+	whsvr := newTestServer(t, `[]`)
+	whsvr.updatePausedMetric()
+	if v := testutil.ToFloat64(webhookPaused); v != 0 {
+		t.Errorf("webhook_paused = %v, want 0 when not paused", v)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// registerBackoff spaces out the registration attempts over about half a
+// minute
+var registerBackoff = wait.Backoff{
+	Duration: time.Second,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    6,
+}
+
+// registerWebhook creates the MutatingWebhookConfiguration or updates the
+// existing one. Errors that retrying can't fix, like missing permissions, are
+// returned right away; others are retried with registerBackoff.
+func registerWebhook(client kubernetes.Interface, cfg *admissionregistrationv1beta1.MutatingWebhookConfiguration) error {
+	var lastErr error
+	attempt := 0
+	err := wait.ExponentialBackoff(registerBackoff, func() (bool, error) {
+		attempt++
+		lastErr = applyWebhookConfiguration(client, cfg)
+		switch {
+		case lastErr == nil:
+			return true, nil
+		case apierrors.IsForbidden(lastErr), apierrors.IsUnauthorized(lastErr), apierrors.IsInvalid(lastErr), apierrors.IsBadRequest(lastErr):
+			return false, lastErr
+		}
+		glog.Warningf("Registering %s failed (attempt %d of %d): %v", cfg.Name, attempt, registerBackoff.Steps, lastErr)
+		return false, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return fmt.Errorf("registering %s: giving up after %d attempts: %v", cfg.Name, attempt, lastErr)
+	}
+	if err != nil {
+		return fmt.Errorf("registering %s: %v", cfg.Name, err)
+	}
+	glog.Infof("Registered %s", cfg.Name)
+	return nil
+}
+
+func applyWebhookConfiguration(client kubernetes.Interface, cfg *admissionregistrationv1beta1.MutatingWebhookConfiguration) error {
+	configs := client.AdmissionregistrationV1beta1().MutatingWebhookConfigurations()
+	existing, err := configs.Get(context.TODO(), cfg.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = configs.Create(context.TODO(), cfg, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	update := cfg.DeepCopy()
+	update.ResourceVersion = existing.ResourceVersion
+	_, err = configs.Update(context.TODO(), update, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// maxRemoteAnnotationsSize bounds the body read from a defaultAnnotationsURL
+const maxRemoteAnnotationsSize = 1 << 20
+
+// remoteAnnotations fetches the default annotations of entries that give a
+// defaultAnnotationsURL, keeping the last good document of every URL for when
+// a later fetch fails
+type remoteAnnotations struct {
+	client   *http.Client
+	disabled bool
+
+	mu    sync.Mutex
+	cache map[string]annotationList
+}
+
+func newRemoteAnnotations(timeout time.Duration, disabled bool) *remoteAnnotations {
+	return &remoteAnnotations{
+		client:   &http.Client{Timeout: timeout},
+		disabled: disabled,
+		cache:    map[string]annotationList{},
+	}
+}
+
+// resolve fills in the default annotations of the entries with a
+// defaultAnnotationsURL. An entry whose document can't be fetched keeps the
+// last good document, or its inline defaultAnnotations if there was none;
+// without either it is dropped.
+func (r *remoteAnnotations) resolve(entries []annotationConfig) []annotationConfig {
+	resolved := make([]annotationConfig, 0, len(entries))
+	for _, entry := range entries {
+		if entry.DefaultAnnotationsURL == "" {
+			resolved = append(resolved, entry)
+			continue
+		}
+		annotations, err := r.annotations(&entry)
+		if err != nil {
+			glog.Errorf("Failed to fetch default annotations of %s from %s: %v", entry.describe(), entry.DefaultAnnotationsURL, err)
+		}
+		if len(annotations) == 0 {
+			annotations = entry.DefaultAnnotations
+		}
+		if len(annotations) == 0 {
+			glog.Errorf("Skipping %s, no default annotations from %s", entry.describe(), entry.DefaultAnnotationsURL)
+			continue
+		}
+		entry.DefaultAnnotations = annotations
+		resolved = append(resolved, entry)
+	}
+	return resolved
+}
+
+// annotations returns the document behind the entry's URL, falling back to
+// the cached one with an error when it can't be fetched
+func (r *remoteAnnotations) annotations(entry *annotationConfig) (annotationList, error) {
+	if r.disabled {
+		return nil, fmt.Errorf("remote annotations are disabled")
+	}
+	annotations, err := r.fetch(entry)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		return r.cache[entry.DefaultAnnotationsURL], err
+	}
+	r.cache[entry.DefaultAnnotationsURL] = annotations
+	return annotations, nil
+}
+
+func (r *remoteAnnotations) fetch(entry *annotationConfig) (annotationList, error) {
+	resp, err := r.client.Get(entry.DefaultAnnotationsURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRemoteAnnotationsSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxRemoteAnnotationsSize {
+		return nil, fmt.Errorf("document larger than %d bytes", maxRemoteAnnotationsSize)
+	}
+	var annotations annotationList
+	if err := json.Unmarshal(body, &annotations); err != nil {
+		return nil, err
+	}
+	if len(annotations) == 0 {
+		return nil, fmt.Errorf("document has no annotations")
+	}
+	if errs := entry.annotationErrors(annotations); len(errs) > 0 {
+		return nil, utilerrors.NewAggregate(errs)
+	}
+	return annotations, nil
+}
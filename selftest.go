@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"k8s.io/api/admission/v1beta1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const selfTestUID = types.UID("admission-webhook-self-test")
+
+// selfTestReview returns a canned AdmissionReview creating an ingress in
+// namespace. The ingress opts out of mutation and has no rules, so the answer
+// never carries a patch and nothing is audited or recorded for it.
+func selfTestReview(namespace string) ([]byte, error) {
+	ingress := networkingv1beta1.Ingress{
+		TypeMeta: metav1.TypeMeta{APIVersion: "networking.k8s.io/v1beta1", Kind: "Ingress"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "admission-webhook-self-test",
+			Namespace:   namespace,
+			Annotations: map[string]string{admissionWebhookAnnotationMutateKey: "false"},
+		},
+	}
+	raw, err := json.Marshal(ingress)
+	if err != nil {
+		return nil, err
+	}
+	review := v1beta1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: v1beta1.SchemeGroupVersion.String(), Kind: "AdmissionReview"},
+		Request: &v1beta1.AdmissionRequest{
+			UID:       selfTestUID,
+			Kind:      metav1.GroupVersionKind{Group: "networking.k8s.io", Version: "v1beta1", Kind: "Ingress"},
+			Resource:  metav1.GroupVersionResource{Group: "networking.k8s.io", Version: "v1beta1", Resource: "ingresses"},
+			Name:      ingress.Name,
+			Namespace: ingress.Namespace,
+			Operation: v1beta1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+	return json.Marshal(review)
+}
+
+// selfTest runs selfTestReview through handleAdmission and checks that the
+// answer is one the API server would accept
+func (whsvr *WebhookServer) selfTest(ctx context.Context) error {
+	// a namespace the webhook handles, so the request gets to mutate
+	namespace := whsvr.watchNamespace
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+	body, err := selfTestReview(namespace)
+	if err != nil {
+		return err
+	}
+	review := whsvr.handleAdmission(ctx, "/mutate", body)
+	response := review.Response
+	switch {
+	case review.APIVersion == "" || review.Kind == "":
+		return fmt.Errorf("response has no apiVersion or kind")
+	case response == nil:
+		return fmt.Errorf("no response")
+	case response.UID != selfTestUID:
+		return fmt.Errorf("response for UID %q instead of %q", response.UID, selfTestUID)
+	case !response.Allowed && response.Result != nil:
+		return fmt.Errorf("not allowed: %s", response.Result.Message)
+	case !response.Allowed:
+		return fmt.Errorf("not allowed")
+	case len(response.Patch) > 0:
+		return fmt.Errorf("patched an ingress that opted out: %s", response.Patch)
+	}
+	if _, err := json.Marshal(review); err != nil {
+		return fmt.Errorf("could not encode response: %v", err)
+	}
+	return nil
+}
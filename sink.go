@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/admission/v1beta1"
+)
+
+// decisionSinkTimeout bounds a single POST to the decision sink
+const decisionSinkTimeout = 10 * time.Second
+
+// decisionRecord is the summary of an admission decision sent to the
+// decision sink
+type decisionRecord struct {
+	Timestamp   string   `json:"timestamp"`
+	Webhook     string   `json:"webhook"`
+	Namespace   string   `json:"namespace"`
+	Name        string   `json:"name"`
+	Kind        string   `json:"kind"`
+	Operation   string   `json:"operation"`
+	User        string   `json:"user"`
+	DryRun      bool     `json:"dryRun,omitempty"`
+	Decision    string   `json:"decision"`
+	Message     string   `json:"message,omitempty"`
+	AppliedKeys []string `json:"appliedKeys,omitempty"`
+}
+
+// decisionSink POSTs decision records to an external endpoint from a
+// background goroutine, so admission never waits for it. Records that don't
+// fit in the queue are dropped. A nil *decisionSink discards everything.
+type decisionSink struct {
+	url    string
+	client *http.Client
+	queue  chan decisionRecord
+}
+
+// newDecisionSink starts sending to url, queueing up to queueSize records.
+// An empty url disables the sink.
+func newDecisionSink(url string, queueSize int) *decisionSink {
+	if url == "" {
+		return nil
+	}
+	s := &decisionSink{
+		url:    url,
+		client: &http.Client{Timeout: decisionSinkTimeout},
+		queue:  make(chan decisionRecord, queueSize),
+	}
+	go s.run()
+	return s
+}
+
+// record queues the decision of response to req, made by webhook
+func (s *decisionSink) record(webhook string, req *v1beta1.AdmissionRequest, response *v1beta1.AdmissionResponse) {
+	if s == nil || req == nil || response == nil || req.UID == selfTestUID {
+		return
+	}
+	record := decisionRecord{
+		Timestamp:   time.Now().UTC().Format(time.RFC3339Nano),
+		Webhook:     webhook,
+		Namespace:   req.Namespace,
+		Name:        req.Name,
+		Kind:        req.Kind.Kind,
+		Operation:   string(req.Operation),
+		User:        req.UserInfo.Username,
+		DryRun:      req.DryRun != nil && *req.DryRun,
+		AppliedKeys: patchedAnnotationKeys(response.Patch),
+	}
+	switch {
+	case !response.Allowed:
+		record.Decision = "rejected"
+	case len(response.Patch) > 0:
+		record.Decision = "patched"
+	default:
+		record.Decision = "allowed"
+	}
+	if response.Result != nil {
+		record.Message = response.Result.Message
+	}
+	select {
+	case s.queue <- record:
+	default:
+		decisionSinkDropped.Inc()
+	}
+}
+
+func (s *decisionSink) run() {
+	for record := range s.queue {
+		if err := s.send(record); err != nil {
+			glog.Warningf("Failed to send the decision for %s/%s to %s: %v", record.Namespace, record.Name, s.url, err)
+		}
+	}
+}
+
+func (s *decisionSink) send(record decisionRecord) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// drain the body so the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+// patchedAnnotationKeys returns the annotation keys patch sets or removes,
+// sorted
+func patchedAnnotationKeys(patch []byte) []string {
+	if len(patch) == 0 {
+		return nil
+	}
+	var ops []patchOperation
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil
+	}
+	const annotationsPath = "/metadata/annotations"
+	seen := map[string]bool{}
+	for _, op := range ops {
+		switch {
+		case strings.HasPrefix(op.Path, annotationsPath+"/"):
+			key := strings.TrimPrefix(op.Path, annotationsPath+"/")
+			seen[strings.NewReplacer("~1", "/", "~0", "~").Replace(key)] = true
+		case op.Path == annotationsPath:
+			// the whole map is added when the object has no annotations yet
+			if annotations, ok := op.Value.(map[string]interface{}); ok {
+				for key := range annotations {
+					seen[key] = true
+				}
+			}
+		}
+	}
+	keys := make([]string, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+
+	"github.com/golang/glog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+)
+
+// tracer records the admission spans. It is a no-op until setupTracing
+// installs an exporting provider.
+var tracer = otel.Tracer("admission-webhook-example")
+
+// setupTracing exports spans over OTLP/gRPC to endpoint. An empty endpoint
+// leaves tracing disabled. The returned function flushes pending spans.
+func setupTracing(ctx context.Context, endpoint string, insecure bool) (func(context.Context) error, error) {
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String("admission-webhook-example"))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	glog.Infof("Exporting traces to %s", endpoint)
+	return provider.Shutdown, nil
+}
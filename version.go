@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+
+	"github.com/golang/glog"
+)
+
+// set at build time with -ldflags "-X main.version=... -X main.gitCommit=..."
+var (
+	version   = "dev"
+	gitCommit = "unknown"
+)
+
+// admission.k8s.io versions of AdmissionReview the webhook answers
+var admissionVersions = []string{"admission.k8s.io/v1", "admission.k8s.io/v1beta1"}
+
+// versionInfo is the body of /version
+type versionInfo struct {
+	Version           string   `json:"version"`
+	GitCommit         string   `json:"gitCommit"`
+	GoVersion         string   `json:"goVersion"`
+	AdmissionVersions []string `json:"admissionVersions"`
+	Features          []string `json:"features"`
+}
+
+// versionHandler serves the build and the features enabled in this process
+func versionHandler(features []string) http.HandlerFunc {
+	info := versionInfo{
+		Version:           version,
+		GitCommit:         gitCommit,
+		GoVersion:         runtime.Version(),
+		AdmissionVersions: admissionVersions,
+		Features:          features,
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(info); err != nil {
+			glog.Errorf("Can't write response: %v", err)
+		}
+	}
+}
@@ -1,20 +1,36 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
+	"os"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang/glog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/api/admission/v1beta1"
 	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
 	corev1 "k8s.io/api/core/v1"
 	networkingv1beta1 "k8s.io/api/networking/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/kubernetes/pkg/apis/core/v1"
 )
 
@@ -24,30 +40,197 @@ var (
 	deserializer  = codecs.UniversalDeserializer()
 )
 
+// bufferPool holds the buffers requests are read into and answered from
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+var envReference = regexp.MustCompile(`\$\{ENV:([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// namespaceLabelReference is ${NAMESPACE_LABEL:key}, the value of a label of
+// the object's namespace
+var namespaceLabelReference = regexp.MustCompile(`\$\{NAMESPACE_LABEL:([^}]+)\}`)
+
 var (
+	// default of -noMutateNamespaces and -noValidateNamespaces
 	ignoredNamespaces = []string{
 		metav1.NamespaceSystem,
 		metav1.NamespacePublic,
 	}
 )
 
+// prefix of the annotations the webhook reads or writes itself
+const admissionWebhookAnnotationPrefix = "admission-webhook-example.citrix.com/"
+
 const (
 	admissionWebhookAnnotationValidateKey = "admission-webhook-example.citrix.com/validate"
 	admissionWebhookAnnotationMutateKey   = "admission-webhook-example.citrix.com/mutate"
 	admissionWebhookAnnotationStatusKey   = "admission-webhook-example.citrix.com/status"
+	// comma separated keys the webhook added, kept with -revertUnmatched
+	admissionWebhookAnnotationManagedKey = "admission-webhook-example.citrix.com/managed-annotations"
+	// "true" exempts an ingress from -requireBackend
+	admissionWebhookAnnotationAllowNoBackendKey = "admission-webhook-example.citrix.com/allow-no-backend"
+
+	// default value of the status annotation marking an object as done
+	admissionWebhookStatusMutated = "mutated"
+)
+
+// what validation does when it can't read the existing ingresses
+const (
+	listerFailureAllow = "allow"
+	listerFailureDeny  = "deny"
+
+	// what validation does with annotation keys that differ only by case
+	caseCollisionsAllow  = "allow"
+	caseCollisionsWarn   = "warn"
+	caseCollisionsReject = "reject"
+)
+
+// key of the audit annotation naming the config entries a mutation came from
+const auditAnnotationAppliedEntry = "applied-entry"
+
+const (
+	citrixFrontendIPAnnotation   = "ingress.citrix.com/frontend-ip"
+	citrixSecurePortAnnotation   = "ingress.citrix.com/secure-port"
+	citrixInsecurePortAnnotation = "ingress.citrix.com/insecure-port"
 )
 
 type WebhookServer struct {
-	server             *http.Server
-	defaultAnnotations []map[string]interface{}
+	server *http.Server
+
+	// the configuration files, re-read on SIGHUP
+	annotationCfgFile string
+	policyCfgFile     string
+	defaultNamespace  string             // for entries without a namespace
+	watchNamespace    string             // the only namespace handled, empty for all
+	remote            *remoteAnnotations // fetches defaultAnnotationsURL documents
+	basePolicy        policyConfig       // policy given by the flags
+
+	reloadMu           sync.Mutex   // serializes reloads so an older read can't win
+	configMu           sync.RWMutex // guards the configuration swapped on reload
+	defaultAnnotations []annotationConfig
+	annotationIndex    annotationIndex // defaultAnnotations by ingress name
+	policy             policyConfig
+	configLoaded       bool // both files loaded without errors at least once
+
+	auditLog      *auditLogger
+	decisionSink  *decisionSink  // notified of every decision, nil for none
+	responseCache *responseCache // answers retried requests, nil for none
+	strictEnv     bool
+	statusKey     string // annotation marking objects not to mutate again
+	statusValue   string
+	ingressLister ingressLister
+	// reads namespace labels for namespaceSelector, nil without a client
+	namespaceLister namespaceLister
+	listerTimeout   time.Duration // bounds a List call, 0 for no limit
+	listerFailOpen  bool          // allow when the ingresses can't be listed
+	validateShadow  bool
+	requireBackend  bool          // reject ingresses without backend and rules
+	allowedClasses  []string      // ingress classes validation allows, empty for any
+	allowEmptyClass bool          // allow ingresses without a class along with allowedClasses
+	warnDecisions   bool          // report the mutation decision as a warning
+	requestSlots    chan struct{} // bounds concurrent requests when not nil
+	requestTimeout  time.Duration // deadline of the work done for a request, 0 for none
+	// record added keys and remove them once no entry sets them
+	revertUnmatched bool
+	// records an event on mutated objects when not nil
+	recorder record.EventRecorder
+	// kinds handled by mutation, empty for all
+	allowedKinds []string
+	// pathType set on ingress paths without one, empty to leave them
+	defaultPathType string
+	// move the legacy class annotation to spec.ingressClassName
+	migrateIngressClass bool
+	// add spec.tls for the hosts of ingresses without it
+	defaultTLS bool
+	// what validation does with annotation keys differing only by case
+	caseCollisions string
+	// pauses the webhook without a reload, nil for none
+	pauseConfigMap *pauseConfigMap
+	// writes requests and responses for offline replay, nil for none
+	dumper *requestDumper
+	// asks for a check for stale entries, nil when not checking
+	orphanCheck chan struct{}
+	// compare ingressName to object names exactly instead of ignoring case
+	caseSensitiveMatch bool
+	// reject ingresses asking for a port already used on their frontend IP
+	checkPortConflicts bool
 }
 
 // Webhook Server parameters
 type WhSvrParameters struct {
 	port          int    // webhook server port
+	bindAddress   string // address to listen on, empty for all
+	insecurePort  int    // plain HTTP port for probes and metrics, 0 for none
 	certFile      string // path to the x509 certificate for https
 	keyFile       string // path to the x509 private key matching `CertFile`
 	annotationCfg string // path to annotation configuration file
+	policyCfg     string // path to the optional policy file
+	validateCfg   string // path to a configuration file to check offline
+	genManifests  bool   // print the installation manifests and exit
+	printDefaults bool   // print the effective configuration and exit
+	selfRegister  bool   // create the webhook configuration at startup
+	manifests     manifestOptions
+
+	certSecretName       string        // name of the tls Secret holding the serving certificate
+	certSecretNamespace  string        // namespace of the tls Secret
+	certDir              string        // directory of per hostname certificates
+	expectedDNSName      string        // name the serving certificate must be valid for
+	strictCert           bool          // exit when the certificate doesn't match expectedDNSName
+	emitWebhookCfg       bool          // print the webhook configuration and exit
+	insecure             bool          // serve plain HTTP instead of TLS, for development
+	auditLogFile         string        // path to the mutation audit log, "-" for stdout
+	decisionSinkURL      string        // endpoint every decision is POSTed to, empty for none
+	decisionSinkQueue    int           // decisions waiting to be sent before new ones are dropped
+	dumpDir              string        // directory requests and responses are dumped to, empty for none
+	dumpMaxFiles         int           // dumps kept in dumpDir, 0 for no limit
+	dumpMaxSizeMB        int           // size of the dumps kept in dumpDir, 0 for no limit
+	responseCacheSize    int           // responses kept for retried requests, 0 for none
+	responseCacheTTL     time.Duration // how long a response is kept for retries
+	orphanCheckInterval  time.Duration // how often entries are checked against the ingresses, 0 never
+	auditMaxSizeMB       int           // size at which the audit log is rotated, 0 for never
+	auditMaxBackups      int           // rotated audit logs to keep, 0 for all
+	auditCompress        bool          // gzip rotated audit logs
+	strictEnv            bool          // fail mutation when a ${ENV:NAME} reference is unset
+	revertUnmatched      bool          // remove defaults once no entry sets them
+	emitEvents           bool          // record an event on every mutated object
+	allowedKinds         string        // comma separated kinds mutation handles
+	defaultPathType      string        // pathType for ingress paths without one
+	migrateIngressClass  bool          // move the class annotation to spec.ingressClassName
+	defaultTLS           bool          // add spec.tls with conventional secret names
+	caseSensitiveMatch   bool          // match ingressName with case
+	statusKey            string        // key of the status annotation
+	statusValue          string        // value of the status annotation that skips mutation
+	useInformerCache     bool          // serve namespace lookups from a shared informer
+	checkPortConflicts   bool          // reject ingresses reusing a port of their frontend IP
+	validateShadow       bool          // log validation rejections instead of enforcing them
+	requireBackend       bool          // reject ingresses that route no traffic
+	allowedClasses       string        // comma separated ingress classes validation allows, empty for all
+	allowEmptyClass      bool          // allow ingresses without a class
+	warnDecisions        bool          // warn with the mutation decision on every response
+	maxConcurrent        int           // requests served at once, 0 for no limit
+	requestTimeout       time.Duration // deadline of a single admission request
+	otlpEndpoint         string        // OTLP/gRPC collector to export traces to
+	otlpInsecure         bool          // export traces without TLS
+	forbiddenAnns        string        // comma separated annotations validation rejects
+	allowedAnns          string        // comma separated annotations validation allows, empty for all
+	noMutateNamespaces   string        // comma separated namespaces mutation skips
+	noValidateNamespaces string        // comma separated namespaces validation skips
+	lockdown             bool          // reject all ingress changes
+	lockdownAllowedUsers string        // comma separated users exempt from lockdown
+	listerTimeout        time.Duration // how long validation waits for the ingress list
+	listerFailure        string        // listerFailureAllow or listerFailureDeny
+	caseCollisions       string        // caseCollisionsAllow, caseCollisionsWarn or caseCollisionsReject
+	debugClientCAFile    string        // CAs of the clients allowed on the debug endpoints
+	enablePprof          bool          // serve net/http/pprof on localhost
+	pprofPort            int           // localhost port for pprof
+	logFile              string        // file to write logs to instead of stderr
+	logMaxSizeMB         int           // size at which the log file is rotated
+	defaultNamespace     string        // namespace of entries that don't give one
+	watchNamespace       string        // the only namespace handled, empty for all
+	pauseConfigMap       string        // namespace/name of the ConfigMap whose paused key pauses the webhook
+	remoteTimeout        time.Duration // bounds fetching a defaultAnnotationsURL
+	disableRemote        bool          // ignore defaultAnnotationsURL
 }
 
 type patchOperation struct {
@@ -66,45 +249,137 @@ func init() {
 
 func admissionRequired(ignoredList []string, admissionAnnotationKey string, metadata *metav1.ObjectMeta) bool {
 	// skip special kubernetes system namespaces
-	for _, namespace := range ignoredList {
-		if metadata.Namespace == namespace {
-			glog.Infof("Skip validation for %v for it's in special namespace:%v", metadata.Name, metadata.Namespace)
-			return false
+	if namespaceIgnored(ignoredList, metadata.Namespace) {
+		glog.Infof("Skip validation for %v for it's in special namespace:%v", metadata.Name, metadata.Namespace)
+		return false
+	}
+	return true
+}
+
+// namespaceIgnored reports whether namespace is in ignoredList
+func namespaceIgnored(ignoredList []string, namespace string) bool {
+	for _, ignored := range ignoredList {
+		if namespace == ignored {
+			return true
 		}
 	}
+	return false
+}
+
+// admissionObject is the decoded object of an admission request along with
+// the request details config entries are matched against
+type admissionObject struct {
+	kind      string
+	metadata  *metav1.ObjectMeta
+	operation v1beta1.Operation
+	userInfo  authenticationv1.UserInfo
+	// hosts of the ingress rules, nil for other kinds
+	hosts []string
+	// services the ingress routes to, nil for other kinds
+	backends []string
+	// whether the ingress declares spec.tls
+	hasTLS bool
+	// class of the ingress by effectiveIngressClass
+	ingressClass string
+	// labels of the namespace of the object, nil when not read
+	namespaceLabels labels.Set
+	// changes to the spec applied along with the default annotations
+	specPatch []patchOperation
+}
+
+// matchingEntries returns the config entries that apply to the object, in
+// the order they have to be merged: catch-all entries, then entries matching
+// the name by regular expression, then the ones naming the object. Each
+// group is merged by ascending priority, global entries before namespaced
+// ones of the same priority, and otherwise in file order. With caseSensitive
+// an ingressName has to equal the name exactly.
+func matchingEntries(index annotationIndex, obj *admissionObject, caseSensitive bool) []*annotationConfig {
+	var matched []*annotationConfig
+	for _, dflt := range objectEntries(index, obj, caseSensitive) {
+		if m := firstMismatch(dflt.requestMatchers, obj); m != nil {
+			glog.Infof("Default for %v needs %v, not met by %v of user %v", dflt.describe(), m, obj.operation, obj.userInfo.Username)
+			continue
+		}
+		matched = append(matched, dflt)
+	}
+	return matched
+}
+
+// objectEntries is matchingEntries without the conditions on the request,
+// for looking at an object outside of admission
+func objectEntries(index annotationIndex, obj *admissionObject, caseSensitive bool) []*annotationConfig {
+	name := obj.metadata.Name
+	var matched []*annotationConfig
+	candidates := index[indexKey(obj.kind, wildcardIngressName)]
+	candidates = append(candidates[:len(candidates):len(candidates)], index[regexIndexKey(obj.kind)]...)
+	if name != wildcardIngressName {
+		candidates = append(candidates[:len(candidates):len(candidates)], index[indexKey(obj.kind, name)]...)
+	}
+	for _, dflt := range candidates {
+		glog.V(4).Infof("Checking default for %v/%v", dflt.describe(), name)
+		if caseSensitive && !dflt.namesExactly(name) {
+			continue
+		}
+		if !entryMatchesObject(dflt, obj) {
+			continue
+		}
+		matched = append(matched, dflt)
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		if ri, rj := matched[i].nameRank(), matched[j].nameRank(); ri != rj {
+			return ri < rj
+		}
+		if matched[i].Priority != matched[j].Priority {
+			return matched[i].Priority < matched[j].Priority
+		}
+		return matched[i].Namespace == "" && matched[j].Namespace != ""
+	})
+	return matched
+}
+
+// entryMatchesObject checks the conditions of an entry that depend on the
+// object alone, not on the request made for it
+func entryMatchesObject(dflt *annotationConfig, obj *admissionObject) bool {
+	if m := firstMismatch(dflt.objectMatchers, obj); m != nil {
+		glog.V(4).Infof("Default for %v needs %v on %v/%v", dflt.describe(), m, obj.metadata.Namespace, obj.metadata.Name)
+		return false
+	}
 	return true
 }
 
-func mutationRequired(ignoredList []string, defaultAnnotations []map[string]interface{}, metadata *metav1.ObjectMeta) bool {
-	required := admissionRequired(ignoredList, admissionWebhookAnnotationMutateKey, metadata)
+// mutationRequired decides whether to mutate the object given the config
+// entries that matched it. Objects that opted out with the mutate annotation,
+// or whose statusKey annotation already holds statusValue, are left alone.
+// When not required, skipped says why.
+func mutationRequired(ignoredList []string, matched []*annotationConfig, metadata *metav1.ObjectMeta, statusKey, statusValue string) (required bool, skipped string) {
+	required = admissionRequired(ignoredList, admissionWebhookAnnotationMutateKey, metadata)
+	if !required {
+		skipped = "ignored namespace"
+	}
 	annotations := metadata.GetAnnotations()
 	if annotations == nil {
 		annotations = map[string]string{}
 	}
-	name := metadata.GetName()
-	ingressFound := false
-	for _, dflt := range defaultAnnotations {
-		ingressName, ok := dflt["ingressName"]
-		if !ok {
-			continue
-		}
-		glog.Infof("Checking default for %v/%v", ingressName.(string), metadata.Name)
-		if strings.Compare(strings.ToLower(ingressName.(string)), strings.ToLower(name)) == 0 {
-			ingressFound = true
-			break
-		}
+	ingressFound := len(matched) > 0
+	if required && !ingressFound {
+		required, skipped = false, "no match"
 	}
-	required = required && ingressFound
 	glog.Infof("Mutation policy for %v/%v: required:%v", metadata.Namespace, metadata.Name, required)
 
-	status := annotations[admissionWebhookAnnotationStatusKey]
+	// the object opted out of mutation
+	if strings.EqualFold(annotations[admissionWebhookAnnotationMutateKey], "false") {
+		glog.Infof("Not mutating %v/%v, %v is false", metadata.Namespace, metadata.Name, admissionWebhookAnnotationMutateKey)
+		required, skipped = false, "opted out"
+	}
+
+	status, ok := annotations[statusKey]
 
-	if strings.ToLower(status) == "mutated" {
-		required = false
+	if ok && strings.EqualFold(status, statusValue) {
+		required, skipped = false, "already mutated"
 	}
 
 	glog.Infof("Mutation policy for %v/%v: required:%v", metadata.Namespace, metadata.Name, required)
-	return required
+	return required, skipped
 }
 
 func validationRequired(ignoredList []string, metadata *metav1.ObjectMeta) bool {
@@ -113,54 +388,501 @@ func validationRequired(ignoredList []string, metadata *metav1.ObjectMeta) bool
 	return required
 }
 
-func updateAnnotation(annotations map[string]string, defaultAnnotations map[string]interface{}) (patch []patchOperation) {
+// updateAnnotation returns the operations needed to bring annotations up to
+// date with defaultAnnotations. Keys that already carry the default value are
+// left alone so that re-admitting an already defaulted object is a no-op.
+func updateAnnotation(annotations map[string]string, defaultAnnotations annotationList) []patchOperation {
+	return updateMetadataMap("/metadata/annotations", annotations, defaultAnnotations)
+}
+
+// updateLabels returns the patch setting the default labels that labels
+// doesn't have with that value yet
+func updateLabels(labels map[string]string, defaultLabels annotationList) []patchOperation {
+	return updateMetadataMap("/metadata/labels", labels, defaultLabels)
+}
 
-	for ann, val := range defaultAnnotations {
-		annotations[ann] = val.(string)
+// updateMetadataMap patches the map at path, whose current content is
+// current, to hold defaults. A nil map is added as a whole.
+func updateMetadataMap(path string, current map[string]string, defaults annotationList) (patch []patchOperation) {
+	if current == nil {
+		if len(defaults) == 0 {
+			return nil
+		}
+		return append(patch, patchOperation{
+			Op:    "add",
+			Path:  path,
+			Value: defaults.toMap(),
+		})
+	}
+	for _, pair := range defaults {
+		key, val := pair.Key, pair.Value
+		if value, ok := current[key]; ok && value == val {
+			continue
+		}
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  path + "/" + escapeJSONPointer(key),
+			Value: val,
+		})
 	}
-	patch = append(patch, patchOperation{
-		Op:    "add",
-		Path:  "/metadata/annotations",
-		Value: annotations,
-	})
 
 	return patch
 }
 
-func createPatch(ingressName string, availableAnnotations map[string]string, allDefaultAnnotations []map[string]interface{}) ([]byte, error) {
-	var patch []patchOperation
+// escapeJSONPointer escapes a map key for use in a JSON patch path (RFC 6901)
+func escapeJSONPointer(s string) string {
+	return strings.Replace(strings.Replace(s, "~", "~0", -1), "/", "~1", -1)
+}
 
-	defaultAnnotationsForIngressName := map[string]interface{}{}
-	for _, dflt := range allDefaultAnnotations {
-		name, ok := dflt["ingressName"]
+// expandEnv replaces ${ENV:NAME} references in an annotation value with the
+// value of the environment variable NAME. Unset variables expand to the empty
+// string unless strict is set, in which case they are an error.
+func expandEnv(value string, strict bool) (string, error) {
+	var missing []string
+	expanded := envReference.ReplaceAllStringFunc(value, func(ref string) string {
+		name := envReference.FindStringSubmatch(ref)[1]
+		val, ok := os.LookupEnv(name)
 		if !ok {
+			missing = append(missing, name)
+		}
+		return val
+	})
+	if strict && len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// expandNamespaceLabels replaces ${NAMESPACE_LABEL:key} references in the
+// annotation values with the labels of the namespace. Annotations referring
+// to a label the namespace doesn't have, or when its labels couldn't be read,
+// are dropped.
+func expandNamespaceLabels(annotations annotationList, namespaceLabels labels.Set) annotationList {
+	expanded := make(annotationList, 0, len(annotations))
+	for _, pair := range annotations {
+		missing := false
+		value := namespaceLabelReference.ReplaceAllStringFunc(pair.Value, func(ref string) string {
+			label, ok := namespaceLabels[namespaceLabelReference.FindStringSubmatch(ref)[1]]
+			missing = missing || !ok
+			return label
+		})
+		if missing {
+			glog.Infof("Not adding %s, the namespace has no label it refers to", pair.Key)
+			continue
+		}
+		expanded = append(expanded, annotationPair{Key: pair.Key, Value: value})
+	}
+	return expanded
+}
+
+// ingressHosts returns the distinct hosts of the ingress rules in the order
+// they are declared
+func ingressHosts(ingress *networkingv1beta1.Ingress) []string {
+	var hosts []string
+	seen := map[string]bool{}
+	for _, rule := range ingress.Spec.Rules {
+		if rule.Host == "" || seen[rule.Host] {
+			continue
+		}
+		seen[rule.Host] = true
+		hosts = append(hosts, rule.Host)
+	}
+	return hosts
+}
+
+// ingressBackends returns the distinct service names of the default backend
+// and the rule paths of the ingress, in the order they are declared.
+// Backends that refer to a resource instead of a service have no name and
+// are left out.
+func ingressBackends(ingress *networkingv1beta1.Ingress) []string {
+	var backends []string
+	seen := map[string]bool{}
+	add := func(backend *networkingv1beta1.IngressBackend) {
+		if backend == nil || backend.ServiceName == "" || seen[backend.ServiceName] {
+			return
+		}
+		seen[backend.ServiceName] = true
+		backends = append(backends, backend.ServiceName)
+	}
+	add(ingress.Spec.Backend)
+	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil {
 			continue
 		}
-		ingressName := name.(string)
-		if strings.Compare(strings.ToLower(dflt["ingressName"].(string)), strings.ToLower(ingressName)) == 0 {
-			defaultAnnotationsForIngressName = dflt["defaultAnnotations"].(map[string]interface{})
-			break
+		for i := range rule.HTTP.Paths {
+			add(&rule.HTTP.Paths[i].Backend)
 		}
 	}
-	patch = append(patch, updateAnnotation(availableAnnotations, defaultAnnotationsForIngressName)...)
+	return backends
+}
+
+// expandBackends replaces ${BACKENDS} in the annotation values with the
+// backend services, comma separated. Annotations referring to ${BACKENDS}
+// are dropped when there are none.
+func expandBackends(annotations annotationList, backends []string) annotationList {
+	expanded := make(annotationList, 0, len(annotations))
+	for _, pair := range annotations {
+		if !strings.Contains(pair.Value, backendsPlaceholder) {
+			expanded = append(expanded, pair)
+			continue
+		}
+		if len(backends) == 0 {
+			continue
+		}
+		expanded = append(expanded, annotationPair{Key: pair.Key, Value: strings.Replace(pair.Value, backendsPlaceholder, strings.Join(backends, ","), -1)})
+	}
+	return expanded
+}
+
+// expandHosts replaces ${HOST} in the annotations with the ingress hosts as
+// selected by mode. Annotations referring to ${HOST} are dropped when the
+// ingress has no hosts.
+func expandHosts(annotations annotationList, hosts []string, mode string) annotationList {
+	expanded := make(annotationList, 0, len(annotations))
+	for _, pair := range annotations {
+		key, val := pair.Key, pair.Value
+		if !strings.Contains(key, hostPlaceholder) && !strings.Contains(val, hostPlaceholder) {
+			expanded = append(expanded, pair)
+			continue
+		}
+		if len(hosts) == 0 {
+			continue
+		}
+		switch mode {
+		case hostModePerHost:
+			for _, host := range hosts {
+				expanded = append(expanded, annotationPair{Key: strings.Replace(key, hostPlaceholder, host, -1), Value: strings.Replace(val, hostPlaceholder, host, -1)})
+			}
+		case hostModeAll:
+			expanded = append(expanded, annotationPair{Key: key, Value: strings.Replace(val, hostPlaceholder, strings.Join(hosts, ","), -1)})
+		default:
+			expanded = append(expanded, annotationPair{Key: strings.Replace(key, hostPlaceholder, hosts[0], -1), Value: strings.Replace(val, hostPlaceholder, hosts[0], -1)})
+		}
+	}
+	return expanded
+}
+
+// managedAnnotations returns the keys the managed annotation says the webhook
+// added to the object
+func managedAnnotations(annotations map[string]string) []string {
+	value := annotations[admissionWebhookAnnotationManagedKey]
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// trackManaged adds the managed annotation recording the keys of defaults to
+// them, and returns the operations removing keys the webhook added earlier
+// that are no longer among them
+func trackManaged(annotations map[string]string, defaults annotationList) (annotationList, []patchOperation) {
+	keys := make([]string, 0, len(defaults))
+	current := map[string]bool{}
+	for _, pair := range defaults {
+		keys = append(keys, pair.Key)
+		current[pair.Key] = true
+	}
+	sort.Strings(keys)
+	var remove []patchOperation
+	for _, key := range managedAnnotations(annotations) {
+		if _, ok := annotations[key]; ok && !current[key] {
+			remove = append(remove, patchOperation{Op: "remove", Path: "/metadata/annotations/" + escapeJSONPointer(key)})
+		}
+	}
+	tracked := append(defaults[:len(defaults):len(defaults)], annotationPair{Key: admissionWebhookAnnotationManagedKey, Value: strings.Join(keys, ",")})
+	return tracked, remove
+}
+
+// revertPatch returns the JSON patch removing the annotations the webhook
+// added to an object that no longer matches any entry, along with the managed
+// annotation and the status annotation, or nil when there is nothing to
+// revert or the object is ignored or opted out.
+func revertPatch(ignoredList []string, metadata *metav1.ObjectMeta, statusKey, statusValue string) []byte {
+	annotations := metadata.Annotations
+	if _, ok := annotations[admissionWebhookAnnotationManagedKey]; !ok {
+		return nil
+	}
+	if !admissionRequired(ignoredList, admissionWebhookAnnotationMutateKey, metadata) || strings.EqualFold(annotations[admissionWebhookAnnotationMutateKey], "false") {
+		return nil
+	}
+	var patch []patchOperation
+	keys := append(managedAnnotations(annotations), admissionWebhookAnnotationManagedKey)
+	if status, ok := annotations[statusKey]; ok && strings.EqualFold(status, statusValue) {
+		keys = append(keys, statusKey)
+	}
+	removed := map[string]bool{}
+	for _, key := range keys {
+		if _, ok := annotations[key]; !ok || removed[key] {
+			continue
+		}
+		removed[key] = true
+		patch = append(patch, patchOperation{Op: "remove", Path: "/metadata/annotations/" + escapeJSONPointer(key)})
+	}
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		glog.Errorf("Can't encode patch: %v", err)
+		return nil
+	}
+	return patchBytes
+}
+
+// maxAnnotationsSize is the total size of the annotation keys and values of an
+// object the API server accepts
+const maxAnnotationsSize = 256 * 1024
+
+// annotationsSize returns the total size of the keys and values of the
+// annotations once defaults are set on them
+func annotationsSize(annotations map[string]string, defaults annotationList) int {
+	size := 0
+	for key, value := range annotations {
+		size += len(key) + len(value)
+	}
+	for _, pair := range defaults {
+		if current, ok := annotations[pair.Key]; ok {
+			size -= len(pair.Key) + len(current)
+		}
+		size += len(pair.Key) + len(pair.Value)
+	}
+	return size
+}
+
+// createPatch returns the JSON patch applying the matched config entries to
+// the object, or nil when it already carries all of its default annotations.
+// With track the keys added are recorded in the managed annotation, and the
+// ones recorded earlier that no entry sets anymore are removed.
+func createPatch(obj *admissionObject, matched []*annotationConfig, strictEnv, track bool) ([]byte, error) {
+	var patch []patchOperation
+	metadata := obj.metadata
+
+	// later entries override the value of earlier ones for the same key; the
+	// key keeps the position where it was first set
+	ingressName := metadata.Name
+	var defaultAnnotationsForIngressName annotationList
+	position := map[string]int{}
+	// the entry each key's value ends up coming from, for -v=4
+	source := map[string]string{}
+	for _, dflt := range matched {
+		expanded := make(annotationList, 0, len(dflt.DefaultAnnotations))
+		for _, pair := range dflt.DefaultAnnotations {
+			value, err := expandEnv(pair.Value, strictEnv)
+			if err != nil {
+				return nil, fmt.Errorf("default annotation %s for %s: %v", pair.Key, ingressName, err)
+			}
+			expanded = append(expanded, annotationPair{Key: pair.Key, Value: value})
+		}
+		expanded = expandNamespaceLabels(expandBackends(expanded, obj.backends), obj.namespaceLabels)
+		for _, pair := range expandHosts(expanded, obj.hosts, dflt.HostMode) {
+			source[pair.Key] = dflt.describe()
+			if i, ok := position[pair.Key]; ok {
+				defaultAnnotationsForIngressName[i].Value = pair.Value
+				continue
+			}
+			position[pair.Key] = len(defaultAnnotationsForIngressName)
+			defaultAnnotationsForIngressName = append(defaultAnnotationsForIngressName, pair)
+		}
+	}
+	// labels are merged the same way, keys of an entry in sorted order
+	var defaultLabels annotationList
+	labelPosition := map[string]int{}
+	for _, dflt := range matched {
+		keys := make([]string, 0, len(dflt.DefaultLabels))
+		for key := range dflt.DefaultLabels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if i, ok := labelPosition[key]; ok {
+				defaultLabels[i].Value = dflt.DefaultLabels[key]
+				continue
+			}
+			labelPosition[key] = len(defaultLabels)
+			defaultLabels = append(defaultLabels, annotationPair{Key: key, Value: dflt.DefaultLabels[key]})
+		}
+	}
+	if glog.V(4) {
+		for _, pair := range defaultAnnotationsForIngressName {
+			glog.Infof("Default %s=%q for %s/%s comes from %s", pair.Key, pair.Value, metadata.Namespace, ingressName, source[pair.Key])
+		}
+	}
+	var remove []patchOperation
+	if track {
+		defaultAnnotationsForIngressName, remove = trackManaged(metadata.Annotations, defaultAnnotationsForIngressName)
+	}
+	if size := annotationsSize(metadata.Annotations, defaultAnnotationsForIngressName); size > maxAnnotationsSize {
+		return nil, fmt.Errorf("annotations of %s/%s would be %d bytes with the defaults added, over the limit of %d bytes", metadata.Namespace, ingressName, size, maxAnnotationsSize)
+	}
+	patch = append(patch, updateAnnotation(metadata.Annotations, defaultAnnotationsForIngressName)...)
+	patch = append(patch, remove...)
+	patch = append(patch, updateLabels(metadata.Labels, defaultLabels)...)
+	patch = append(patch, obj.specPatch...)
+	if len(patch) == 0 {
+		return nil, nil
+	}
 	return json.Marshal(patch)
 }
 
+// annotationConfig returns the config entries currently in use
+func (whsvr *WebhookServer) annotationConfig() []annotationConfig {
+	whsvr.configMu.RLock()
+	defer whsvr.configMu.RUnlock()
+	return whsvr.defaultAnnotations
+}
+
+// annotationConfigIndex returns the config entries in use keyed by name
+func (whsvr *WebhookServer) annotationConfigIndex() annotationIndex {
+	whsvr.configMu.RLock()
+	defer whsvr.configMu.RUnlock()
+	return whsvr.annotationIndex
+}
+
+// currentConfig returns the config entries by name and the policy of the
+// same reload, for a request that needs both
+func (whsvr *WebhookServer) currentConfig() (annotationIndex, policyConfig) {
+	whsvr.configMu.RLock()
+	defer whsvr.configMu.RUnlock()
+	return whsvr.annotationIndex, whsvr.policy
+}
+
+// currentPolicy returns the namespace and annotation policy currently in use
+func (whsvr *WebhookServer) currentPolicy() policyConfig {
+	whsvr.configMu.RLock()
+	defer whsvr.configMu.RUnlock()
+	return whsvr.policy
+}
+
+// reloadConfig re-reads the configuration files. As at startup, entries
+// with a problem are dropped; any other problem keeps the configuration in
+// use as a whole.
+func (whsvr *WebhookServer) reloadConfig() (err error) {
+	whsvr.reloadMu.Lock()
+	defer whsvr.reloadMu.Unlock()
+	defer func() {
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		configReloads.WithLabelValues(result).Inc()
+	}()
+	entries, errs := loadAnnotationConfig(whsvr.annotationCfgFile, whsvr.defaultNamespace)
+	if !entryErrorsOnly(errs) {
+		return utilerrors.NewAggregate(errs)
+	}
+	for _, err := range errs {
+		glog.Errorf("Failed to load default annotations: %v", err)
+	}
+	for _, warning := range configWarnings(entries) {
+		glog.Warningf("Default annotations: %s", warning)
+	}
+	entries = whsvr.remote.resolve(entries)
+	policy, err := loadPolicyConfig(whsvr.basePolicy, whsvr.policyCfgFile)
+	if err != nil {
+		return err
+	}
+	whsvr.configMu.Lock()
+	whsvr.defaultAnnotations = entries
+	whsvr.annotationIndex = newAnnotationIndex(entries)
+	whsvr.policy = policy
+	whsvr.configLoaded = true
+	whsvr.configMu.Unlock()
+	whsvr.responseCache.purge()
+	configInUse(entries)
+	whsvr.updatePausedMetric()
+	whsvr.requestOrphanCheck()
+	return nil
+}
+
+// isConfigLoaded reports whether a configuration has been loaded that
+// admission requests can be served with
+func (whsvr *WebhookServer) isConfigLoaded() bool {
+	whsvr.configMu.RLock()
+	defer whsvr.configMu.RUnlock()
+	return whsvr.configLoaded
+}
+
+// namespaceLabels returns the labels of the namespace for matching
+// namespaceSelector, or nil when they can't be read
+func (whsvr *WebhookServer) namespaceLabels(ctx context.Context, namespace string) labels.Set {
+	if whsvr.namespaceLister == nil {
+		glog.Warningf("Can't read the labels of namespace %s without a kubernetes client, entries with a namespaceSelector don't apply and namespace label references are left out", namespace)
+		return nil
+	}
+	values, err := whsvr.namespaceLister.Labels(ctx, namespace)
+	if err != nil {
+		glog.Errorf("Could not read the labels of namespace %s, entries with a namespaceSelector don't apply and namespace label references are left out: %v", namespace, err)
+		return nil
+	}
+	if values == nil {
+		return labels.Set{}
+	}
+	return labels.Set(values)
+}
+
+// nilRequestResponse answers an AdmissionReview that carries no request
+func nilRequestResponse() *v1beta1.AdmissionResponse {
+	glog.Errorf("AdmissionReview has no request")
+	return &v1beta1.AdmissionResponse{
+		Result: &metav1.Status{
+			Message: "admission request is nil",
+		},
+	}
+}
+
+// requestObjectMissing returns an error for a create or update that doesn't
+// carry the object, so it's answered before mutate or validate look at it
+func requestObjectMissing(req *v1beta1.AdmissionRequest) error {
+	if req.Operation != v1beta1.Create && req.Operation != v1beta1.Update {
+		return nil
+	}
+	if raw := bytes.TrimSpace(req.Object.Raw); len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return fmt.Errorf("%s request for %s %s/%s has no object", req.Operation, req.Kind.Kind, req.Namespace, req.Name)
+	}
+	return nil
+}
+
 // main mutation process
-func (whsvr *WebhookServer) mutate(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+func (whsvr *WebhookServer) mutate(ctx context.Context, ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
 	req := ar.Request
+	if req == nil {
+		return nilRequestResponse()
+	}
 	var (
-		objectMeta                      *metav1.ObjectMeta
+		service                         corev1.Service
 		resourceNamespace, resourceName string
 	)
+	obj := &admissionObject{
+		kind:      req.Kind.Kind,
+		operation: req.Operation,
+		userInfo:  req.UserInfo,
+	}
 
-	glog.Infof("Mutating AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v",
-		req.Kind, req.Namespace, req.Name, resourceName, req.UID, req.Operation, req.UserInfo)
+	glog.Infof("Mutating AdmissionReview for Kind=%v, Resource=%v, RequestResource=%v, Namespace=%v Name=%v UID=%v patchOperation=%v UserInfo=%v",
+		req.Kind, req.Resource, req.RequestResource, req.Namespace, req.Name, req.UID, req.Operation, req.UserInfo)
 
-	switch req.Kind.Kind {
-	case "Ingress":
-		var ingress networkingv1beta1.Ingress
-		if err := json.Unmarshal(req.Object.Raw, &ingress); err != nil {
+	if req.SubResource != "" {
+		glog.Infof("Not mutating subresource %s of %s/%s", req.SubResource, req.Namespace, req.Name)
+		return whsvr.withDecision(&v1beta1.AdmissionResponse{
+			Allowed: true,
+		}, "skipped: subresource "+req.SubResource)
+	}
+	if !whsvr.kindAllowed(req.Kind.Kind) {
+		glog.Warningf("Not mutating %s %s/%s, kind not in --allowedKinds, check the rules of the webhook configuration", req.Kind.Kind, req.Namespace, req.Name)
+		return whsvr.withDecision(&v1beta1.AdmissionResponse{
+			Allowed: true,
+		}, "skipped: kind "+req.Kind.Kind+" not allowed")
+	}
+	index, policy := whsvr.currentConfig()
+	// the request names the namespace, so ignored ones are skipped before
+	// paying for decoding the object
+	if req.Namespace != "" && namespaceIgnored(policy.NoMutateNamespaces, req.Namespace) {
+		glog.Infof("Not mutating %s/%s, it's in an ignored namespace", req.Namespace, req.Name)
+		return whsvr.withDecision(&v1beta1.AdmissionResponse{
+			Allowed: true,
+		}, "skipped: ignored namespace")
+	}
+	switch {
+	case req.Resource.Resource == "ingresses":
+		ingress, err := decodeIngress(req)
+		if err != nil {
 			glog.Errorf("Could not unmarshal raw object: %v", err)
 			return &v1beta1.AdmissionResponse{
 				Result: &metav1.Status{
@@ -168,17 +890,79 @@ func (whsvr *WebhookServer) mutate(ar *v1beta1.AdmissionReview) *v1beta1.Admissi
 				},
 			}
 		}
-		resourceName, resourceNamespace, objectMeta = ingress.Name, ingress.Namespace, &ingress.ObjectMeta
-
+		resourceName, resourceNamespace, obj.metadata = ingress.Name, ingress.Namespace, &ingress.ObjectMeta
+		obj.hosts = ingressHosts(ingress)
+		obj.backends = ingressBackends(ingress)
+		obj.hasTLS = len(ingress.Spec.TLS) > 0
+		obj.ingressClass = effectiveIngressClass(ingress)
+		if whsvr.defaultPathType != "" {
+			obj.specPatch = pathTypePatch(ingress, whsvr.defaultPathType)
+		}
+		if whsvr.migrateIngressClass {
+			obj.specPatch = append(obj.specPatch, ingressClassPatch(ingress)...)
+		}
+		if whsvr.defaultTLS {
+			obj.specPatch = append(obj.specPatch, tlsPatch(ingress)...)
+		}
+	case req.Resource.Group == "" && req.Resource.Resource == "services":
+		if err := json.Unmarshal(req.Object.Raw, &service); err != nil {
+			glog.Errorf("Could not unmarshal raw object: %v", err)
+			return &v1beta1.AdmissionResponse{
+				Result: &metav1.Status{
+					Message: err.Error(),
+				},
+			}
+		}
+		resourceName, resourceNamespace, obj.metadata = service.Name, service.Namespace, &service.ObjectMeta
+	default:
+		glog.Warningf("Not mutating unexpected resource %v of %s/%s, check the rules of the webhook configuration", req.Resource, req.Namespace, req.Name)
+		return whsvr.withDecision(&v1beta1.AdmissionResponse{
+			Allowed: true,
+		}, "skipped: unexpected resource "+req.Resource.String())
 	}
 
-	if !mutationRequired(ignoredNamespaces, whsvr.defaultAnnotations, objectMeta) {
+	if needsNamespaceLabels(index) {
+		obj.namespaceLabels = whsvr.namespaceLabels(ctx, resourceNamespace)
+	}
+	matched := matchingEntries(index, obj, whsvr.caseSensitiveMatch)
+	var applied []string
+	for _, dflt := range matched {
+		applied = append(applied, dflt.describe())
+	}
+	if whsvr.revertUnmatched && len(matched) == 0 && req.Operation == v1beta1.Update {
+		if patchBytes := revertPatch(policy.NoMutateNamespaces, obj.metadata, whsvr.statusKey, whsvr.statusValue); patchBytes != nil {
+			glog.Infof("Reverting defaults of %s/%s, it no longer matches any entry: patch=%v", resourceNamespace, resourceName, string(patchBytes))
+			logPatchedAnnotations(req.Object.Raw, patchBytes, resourceNamespace, resourceName)
+			whsvr.auditLog.log(req, resourceNamespace, resourceName, patchBytes)
+			return whsvr.withDecision(patchResponse(patchBytes, nil), "no match, reverted earlier defaults")
+		}
+	}
+	if required, skipped := mutationRequired(policy.NoMutateNamespaces, matched, obj.metadata, whsvr.statusKey, whsvr.statusValue); !required {
+		if skipped == "no match" && len(obj.specPatch) > 0 {
+			// spec defaults apply to every ingress, not only configured ones
+			patchBytes, err := json.Marshal(obj.specPatch)
+			if err != nil {
+				return &v1beta1.AdmissionResponse{
+					Result: &metav1.Status{
+						Message: err.Error(),
+					},
+				}
+			}
+			glog.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
+			logPatchedAnnotations(req.Object.Raw, patchBytes, resourceNamespace, resourceName)
+			whsvr.auditLog.log(req, resourceNamespace, resourceName, patchBytes)
+			return whsvr.withDecision(patchResponse(patchBytes, nil), "no match, defaulted spec")
+		}
 		glog.Infof("Skipping validation for %s/%s due to policy check", resourceNamespace, resourceName)
-		return &v1beta1.AdmissionResponse{
-			Allowed: true,
+		decision := skipped
+		if skipped != "no match" {
+			decision = "skipped: " + skipped
 		}
+		return whsvr.withDecision(&v1beta1.AdmissionResponse{
+			Allowed: true,
+		}, decision)
 	}
-	patchBytes, err := createPatch(resourceName, objectMeta.GetAnnotations(), whsvr.defaultAnnotations)
+	patchBytes, err := createPatch(obj, matched, whsvr.strictEnv, whsvr.revertUnmatched)
 	if err != nil {
 		return &v1beta1.AdmissionResponse{
 			Result: &metav1.Status{
@@ -186,25 +970,452 @@ func (whsvr *WebhookServer) mutate(ar *v1beta1.AdmissionReview) *v1beta1.Admissi
 			},
 		}
 	}
+	if patchBytes == nil {
+		glog.Infof("No changes needed for %s/%s", resourceNamespace, resourceName)
+		return whsvr.withDecision(&v1beta1.AdmissionResponse{
+			Allowed: true,
+		}, "matched "+strings.Join(applied, ",")+", no changes needed")
+	}
 
 	glog.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
-	return &v1beta1.AdmissionResponse{
+	logPatchedAnnotations(req.Object.Raw, patchBytes, resourceNamespace, resourceName)
+	whsvr.auditLog.log(req, resourceNamespace, resourceName, patchBytes)
+	if whsvr.recorder != nil && (req.DryRun == nil || !*req.DryRun) {
+		whsvr.recorder.Eventf(requestObjectReference(req, obj.metadata), corev1.EventTypeNormal, eventReasonDefaultsApplied, "Applied default annotations from %s", strings.Join(applied, ", "))
+	}
+
+	return whsvr.withDecision(patchResponse(patchBytes, applied), "mutated by "+strings.Join(applied, ","))
+}
+
+// patchResponse allows the object with the patch, recording the config
+// entries it came from, if any, in the audit log of the API server
+func patchResponse(patchBytes []byte, applied []string) *v1beta1.AdmissionResponse {
+	response := &v1beta1.AdmissionResponse{
 		Allowed: true,
 		Patch:   patchBytes,
+		// JSON Patch is the only type the API server accepts from admission
+		// webhooks; updateAnnotation adds single keys so nothing is replaced
 		PatchType: func() *v1beta1.PatchType {
 			pt := v1beta1.PatchTypeJSONPatch
 			return &pt
 		}(),
 	}
+	if len(applied) > 0 {
+		// the API server prefixes the key with the webhook name
+		response.AuditAnnotations = map[string]string{
+			auditAnnotationAppliedEntry: strings.Join(applied, ","),
+		}
+	}
+	return response
+}
+
+// kindAllowed reports whether the webhook handles objects of kind. Without
+// -allowedKinds every kind it can decode is handled.
+func (whsvr *WebhookServer) kindAllowed(kind string) bool {
+	return len(whsvr.allowedKinds) == 0 || containsString(whsvr.allowedKinds, kind)
+}
+
+// withDecision adds the mutation decision to the warnings of the response
+// when -debugMatch is set, so that kubectl shows it
+func (whsvr *WebhookServer) withDecision(response *v1beta1.AdmissionResponse, decision string) *v1beta1.AdmissionResponse {
+	if whsvr.warnDecisions {
+		response.Warnings = append(response.Warnings, "admission-webhook-example: "+decision)
+	}
+	return response
+}
+
+// matchesAnnotationPattern reports whether key is one of patterns. A pattern
+// ending in "*" matches every key with that prefix.
+func matchesAnnotationPattern(key string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(key, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if key == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// annotationPolicy returns errors naming the annotations that are forbidden
+// and, when an allowlist is given, the ones not allowed
+func annotationPolicy(annotations map[string]string, forbidden, allowed []string) []error {
+	var forbiddenKeys, unknownKeys []string
+	for key := range annotations {
+		if matchesAnnotationPattern(key, forbidden) {
+			forbiddenKeys = append(forbiddenKeys, key)
+		} else if len(allowed) > 0 && !matchesAnnotationPattern(key, allowed) {
+			unknownKeys = append(unknownKeys, key)
+		}
+	}
+	sort.Strings(forbiddenKeys)
+	sort.Strings(unknownKeys)
+	var errs []error
+	if len(forbiddenKeys) > 0 {
+		errs = append(errs, fmt.Errorf("annotations %s are forbidden", strings.Join(forbiddenKeys, ", ")))
+	}
+	if len(unknownKeys) > 0 {
+		errs = append(errs, fmt.Errorf("annotations %s are not in the list of allowed annotations", strings.Join(unknownKeys, ", ")))
+	}
+	return errs
+}
+
+// annotationsPresent returns an error for each of required that annotations
+// lack or whose value doesn't match its pattern
+func annotationsPresent(annotations map[string]string, required []requiredAnnotation) []error {
+	var errs []error
+	for _, annotation := range required {
+		value, ok := annotations[annotation.Key]
+		switch {
+		case !ok:
+			errs = append(errs, fmt.Errorf("annotation %s is required", annotation.Key))
+		case annotation.pattern != nil && !annotation.pattern.MatchString(value):
+			errs = append(errs, fmt.Errorf("annotation %s is %q, it must match %s", annotation.Key, value, annotation.Pattern))
+		}
+	}
+	return errs
+}
+
+// annotationCaseCollisions returns an error naming the annotation keys that
+// only differ by case, such as Example.com/foo and example.com/foo
+func annotationCaseCollisions(annotations map[string]string) error {
+	byLower := map[string][]string{}
+	for key := range annotations {
+		lower := strings.ToLower(key)
+		byLower[lower] = append(byLower[lower], key)
+	}
+	var collisions []string
+	for _, keys := range byLower {
+		if len(keys) > 1 {
+			sort.Strings(keys)
+			collisions = append(collisions, strings.Join(keys, " and "))
+		}
+	}
+	if len(collisions) == 0 {
+		return nil
+	}
+	sort.Strings(collisions)
+	return fmt.Errorf("annotations %s differ only by case", strings.Join(collisions, ", "))
+}
+
+// backendRequired returns an error for an ingress that has neither a default
+// backend nor any rules and so routes no traffic, unless it opts out
+func backendRequired(ingress *networkingv1beta1.Ingress) error {
+	if ingress.Spec.Backend != nil || len(ingress.Spec.Rules) > 0 {
+		return nil
+	}
+	if strings.EqualFold(ingress.Annotations[admissionWebhookAnnotationAllowNoBackendKey], "true") {
+		return nil
+	}
+	return fmt.Errorf("ingress has neither spec.defaultBackend nor spec.rules and would route no traffic; add one, or annotate it with %s: \"true\" if this is intended", admissionWebhookAnnotationAllowNoBackendKey)
+}
+
+// ingressClassAllowed returns an error for an ingress whose class isn't one of
+// allowed, or that has no class unless allowEmpty
+func ingressClassAllowed(ingress *networkingv1beta1.Ingress, allowed []string, allowEmpty bool) error {
+	class := effectiveIngressClass(ingress)
+	switch {
+	case class == "" && allowEmpty:
+		return nil
+	case class == "":
+		return fmt.Errorf("ingress has no class, set spec.ingressClassName to one of %s", strings.Join(allowed, ", "))
+	case !containsString(allowed, class):
+		return fmt.Errorf("ingress class %q is not allowed, use one of %s", class, strings.Join(allowed, ", "))
+	}
+	return nil
+}
+
+// portConflict returns an error when another ingress on the same frontend IP
+// already asks for one of the ports this ingress asks for. Ingresses without
+// a frontend IP share the default VIP and never conflict.
+func portConflict(ingress *networkingv1beta1.Ingress, existing []*networkingv1beta1.Ingress) error {
+	frontendIP := ingress.Annotations[citrixFrontendIPAnnotation]
+	if frontendIP == "" {
+		return nil
+	}
+	for _, portAnnotation := range []string{citrixSecurePortAnnotation, citrixInsecurePortAnnotation} {
+		port, ok := ingress.Annotations[portAnnotation]
+		if !ok {
+			continue
+		}
+		for _, other := range existing {
+			if other.Namespace == ingress.Namespace && other.Name == ingress.Name {
+				continue
+			}
+			if other.Annotations[citrixFrontendIPAnnotation] != frontendIP {
+				continue
+			}
+			if other.Annotations[citrixSecurePortAnnotation] == port || other.Annotations[citrixInsecurePortAnnotation] == port {
+				return fmt.Errorf("port %s requested by %s is already used by ingress %s/%s on frontend-ip %q",
+					port, portAnnotation, other.Namespace, other.Name, frontendIP)
+			}
+		}
+	}
+	return nil
+}
+
+// deadline returns how long the request may take: -requestTimeout, or less
+// if the API server says in the timeout parameter that it gives up sooner
+func (whsvr *WebhookServer) deadline(r *http.Request) time.Duration {
+	timeout := whsvr.requestTimeout
+	if param := r.URL.Query().Get("timeout"); param != "" {
+		if d, err := time.ParseDuration(param); err == nil && d > 0 && (timeout <= 0 || d < timeout) {
+			timeout = d
+		}
+	}
+	return timeout
+}
+
+// main validation process
+func (whsvr *WebhookServer) validate(ctx context.Context, ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+	if ar.Request == nil {
+		return nilRequestResponse()
+	}
+	// a lockdown is enforced even in shadow mode
+	if response := lockdownResponse(whsvr.currentPolicy(), ar.Request); response != nil {
+		return response
+	}
+	response := whsvr.validateIngress(ctx, ar)
+	if whsvr.validateShadow && !response.Allowed {
+		// observe only: report what enforcing would have done and let it through
+		message := ""
+		if response.Result != nil {
+			message = response.Result.Message
+		}
+		glog.Warningf("Shadow validation would reject %s/%s (UID=%v): %s", ar.Request.Namespace, ar.Request.Name, ar.Request.UID, message)
+		validationWouldReject.Inc()
+		return &v1beta1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: response.Warnings,
+		}
+	}
+	return response
+}
+
+func (whsvr *WebhookServer) validateIngress(ctx context.Context, ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+	req := ar.Request
+
+	glog.Infof("Validating AdmissionReview for Kind=%v, Resource=%v, RequestResource=%v, Namespace=%v Name=%v UID=%v patchOperation=%v UserInfo=%v",
+		req.Kind, req.Resource, req.RequestResource, req.Namespace, req.Name, req.UID, req.Operation, req.UserInfo)
+
+	if req.Resource.Resource != "ingresses" || req.SubResource != "" {
+		glog.Warningf("Not validating unexpected resource %v (subresource %q) of %s/%s, check the rules of the webhook configuration", req.Resource, req.SubResource, req.Namespace, req.Name)
+		return &v1beta1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+	ingress, err := decodeIngress(req)
+	if err != nil {
+		glog.Errorf("Could not unmarshal raw object: %v", err)
+		return &v1beta1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
+	}
+
+	policy := whsvr.currentPolicy()
+	if !validationRequired(policy.NoValidateNamespaces, &ingress.ObjectMeta) {
+		glog.Infof("Skipping validation for %s/%s due to policy check", ingress.Namespace, ingress.Name)
+		return &v1beta1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	// report every failed check at once rather than one per attempt
+	errs := annotationPolicy(ingress.Annotations, policy.ForbiddenAnnotations, policy.AllowedAnnotations)
+	errs = append(errs, annotationsPresent(ingress.Annotations, policy.RequiredAnnotations)...)
+	var warnings []string
+	if err := annotationCaseCollisions(ingress.Annotations); err != nil {
+		switch whsvr.caseCollisions {
+		case caseCollisionsReject:
+			errs = append(errs, err)
+		case caseCollisionsWarn:
+			glog.Warningf("Ingress %s/%s: %v", ingress.Namespace, ingress.Name, err)
+			warnings = append(warnings, err.Error())
+		}
+	}
+	if whsvr.requireBackend {
+		if err := backendRequired(ingress); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(whsvr.allowedClasses) > 0 {
+		if err := ingressClassAllowed(ingress, whsvr.allowedClasses, whsvr.allowEmptyClass); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	errs = append(errs, checkValidationRules(policy.ValidationRules, ingress)...)
+
+	switch {
+	case !whsvr.checkPortConflicts:
+		// the existing ingresses are only read for the port conflict check
+	case whsvr.ingressLister == nil:
+		glog.Warningf("Skipping port conflict check for %s/%s, no kubernetes client", ingress.Namespace, ingress.Name)
+	case len(errs) > 0 && !whsvr.ingressLister.HasSynced():
+		glog.Warningf("Skipping port conflict check for %s/%s, ingress cache not synced", ingress.Namespace, ingress.Name)
+	case !whsvr.ingressLister.HasSynced():
+		return whsvr.listerFallback(ingress, fmt.Errorf("ingress cache not synced"), warnings)
+	default:
+		listCtx, span := tracer.Start(ctx, "list ingresses")
+		if whsvr.listerTimeout > 0 {
+			var cancel context.CancelFunc
+			listCtx, cancel = context.WithTimeout(listCtx, whsvr.listerTimeout)
+			defer cancel()
+		}
+		existing, err := whsvr.ingressLister.List(listCtx)
+		span.End()
+		if err != nil && len(errs) == 0 {
+			return whsvr.listerFallback(ingress, fmt.Errorf("could not list ingresses: %v", err), warnings)
+		} else if err != nil {
+			glog.Warningf("Skipping port conflict check for %s/%s, could not list ingresses: %v", ingress.Namespace, ingress.Name, err)
+		} else if err := portConflict(ingress, existing); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		glog.Infof("Rejecting %s/%s: %v", ingress.Namespace, ingress.Name, utilerrors.NewAggregate(errs))
+		response := validationFailure(errs)
+		response.Warnings = warnings
+		return response
+	}
+	return &v1beta1.AdmissionResponse{
+		Allowed:  true,
+		Warnings: warnings,
+	}
+}
+
+// validationFailure rejects an object for all the errors found, each listed
+// as a cause of the status and joined in its message
+func validationFailure(errs []error) *v1beta1.AdmissionResponse {
+	messages := make([]string, 0, len(errs))
+	causes := make([]metav1.StatusCause, 0, len(errs))
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+		causes = append(causes, metav1.StatusCause{
+			Type:    metav1.CauseTypeFieldValueInvalid,
+			Message: err.Error(),
+		})
+	}
+	return &v1beta1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Message: strings.Join(messages, "; "),
+			Details: &metav1.StatusDetails{Causes: causes},
+		},
+	}
+}
+
+// lockdownResponse rejects a create or update of an ingress while the policy
+// is in lockdown, unless the user making it is allowed to
+func lockdownResponse(policy policyConfig, req *v1beta1.AdmissionRequest) *v1beta1.AdmissionResponse {
+	if !policy.Lockdown || req.Resource.Resource != "ingresses" {
+		return nil
+	}
+	if req.Operation != v1beta1.Create && req.Operation != v1beta1.Update {
+		return nil
+	}
+	if containsString(policy.LockdownAllowedUsers, req.UserInfo.Username) {
+		glog.Infof("Allowing %s/%s by %s during lockdown", req.Namespace, req.Name, req.UserInfo.Username)
+		return nil
+	}
+	glog.Infof("Rejecting %s/%s by %s, ingress changes are locked down", req.Namespace, req.Name, req.UserInfo.Username)
+	return &v1beta1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Message: "ingress changes are locked down by the cluster administrators, retry once the lockdown is lifted",
+		},
+	}
+}
+
+// listerFallback answers for an ingress whose conflict check couldn't read the
+// existing ingresses, allowing it only when the webhook is set to fail open.
+// The warnings of the other checks are passed on either way.
+func (whsvr *WebhookServer) listerFallback(ingress *networkingv1beta1.Ingress, err error, warnings []string) *v1beta1.AdmissionResponse {
+	if whsvr.listerFailOpen {
+		glog.Warningf("Allowing %s/%s without port conflict check: %v", ingress.Namespace, ingress.Name, err)
+		return &v1beta1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: warnings,
+		}
+	}
+	glog.Errorf("Rejecting %s/%s, port conflict check failed: %v", ingress.Namespace, ingress.Name, err)
+	return &v1beta1.AdmissionResponse{
+		Result: &metav1.Status{
+			Message: err.Error(),
+		},
+		Warnings: warnings,
+	}
+}
+
+// readyz reports ready once the configuration is loaded, any cache that
+// admission reads from has synced and a canned request is answered correctly
+func (whsvr *WebhookServer) readyz(w http.ResponseWriter, r *http.Request) {
+	if !whsvr.isConfigLoaded() {
+		http.Error(w, "configuration not loaded", http.StatusServiceUnavailable)
+		return
+	}
+	if whsvr.ingressLister != nil && !whsvr.ingressLister.HasSynced() {
+		http.Error(w, "ingress cache not synced", http.StatusServiceUnavailable)
+		return
+	}
+	if whsvr.namespaceLister != nil && !whsvr.namespaceLister.HasSynced() {
+		http.Error(w, "namespace cache not synced", http.StatusServiceUnavailable)
+		return
+	}
+	if err := whsvr.selfTest(r.Context()); err != nil {
+		glog.Errorf("Self test failed: %v", err)
+		http.Error(w, fmt.Sprintf("self test failed: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
 }
 
 // Serve method for webhook server
 func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
+	if !whsvr.isConfigLoaded() {
+		glog.Warningf("Rejecting %s, configuration not loaded", r.URL.Path)
+		http.Error(w, "configuration not loaded", http.StatusServiceUnavailable)
+		return
+	}
+	if whsvr.requestSlots != nil {
+		select {
+		case whsvr.requestSlots <- struct{}{}:
+			defer func() { <-whsvr.requestSlots }()
+		default:
+			glog.Warningf("Rejecting %s, %d requests already in flight", r.URL.Path, cap(whsvr.requestSlots))
+			http.Error(w, "too many concurrent requests", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufferPool.Put(buf)
+
 	var body []byte
 	if r.Body != nil {
-		if data, err := ioutil.ReadAll(r.Body); err == nil {
-			body = data
+		var reader io.Reader = r.Body
+		// some proxies compress the request on its way from the API server
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				glog.Errorf("Can't read gzip body: %v", err)
+				http.Error(w, fmt.Sprintf("invalid gzip body: %v", err), http.StatusBadRequest)
+				return
+			}
+			defer gz.Close()
+			reader = gz
 		}
+		if _, err := buf.ReadFrom(reader); err != nil {
+			glog.Errorf("Can't read body: %v", err)
+			http.Error(w, fmt.Sprintf("could not read body: %v", err), http.StatusBadRequest)
+			return
+		}
+		body = buf.Bytes()
 	}
 	if len(body) == 0 {
 		glog.Error("empty body")
@@ -220,6 +1431,41 @@ func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, r.URL.Path)
+	defer span.End()
+	if timeout := whsvr.deadline(r); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	admissionReview := whsvr.handleAdmission(ctx, r.URL.Path, body)
+
+	// the request body has been decoded, so the buffer is free for the response
+	buf.Reset()
+	if err := json.NewEncoder(buf).Encode(admissionReview); err != nil {
+		glog.Errorf("Can't encode response: %v", err)
+		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := ctx.Err(); err != nil {
+		glog.Warningf("Answering %s after its deadline: %v", r.URL.Path, err)
+	}
+	glog.Infof("Ready to write reponse ...")
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		glog.Errorf("Can't write response: %v", err)
+		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// handleAdmission decodes the AdmissionReview in body, has the handler for
+// path answer it and returns the review to send back. It depends on nothing
+// but its arguments and the configuration, so it can be fed any bytes; a body
+// that doesn't decode is answered with an error in the review.
+func (whsvr *WebhookServer) handleAdmission(ctx context.Context, path string, body []byte) *v1beta1.AdmissionReview {
+	span := trace.SpanFromContext(ctx)
 	var admissionResponse *v1beta1.AdmissionResponse
 	ar := v1beta1.AdmissionReview{}
 	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
@@ -229,32 +1475,71 @@ func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
 				Message: err.Error(),
 			},
 		}
+	} else if ar.Request == nil {
+		admissionResponse = nilRequestResponse()
+	} else if whsvr.paused() {
+		glog.Infof("Paused, allowing %s/%s untouched", ar.Request.Namespace, ar.Request.Name)
+		admissionResponse = whsvr.withDecision(&v1beta1.AdmissionResponse{
+			Allowed: true,
+		}, "skipped: paused")
+	} else if whsvr.watchNamespace != "" && ar.Request.Namespace != whsvr.watchNamespace {
+		glog.Infof("Not admitting %s/%s, only namespace %s is watched", ar.Request.Namespace, ar.Request.Name, whsvr.watchNamespace)
+		admissionResponse = whsvr.withDecision(&v1beta1.AdmissionResponse{
+			Allowed: true,
+		}, "skipped: namespace not watched")
+	} else if err := requestObjectMissing(ar.Request); err != nil {
+		glog.Errorf("Can't admit %s/%s: %v", ar.Request.Namespace, ar.Request.Name, err)
+		admissionResponse = &v1beta1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
 	} else {
-		fmt.Println(r.URL.Path)
-		if r.URL.Path == "/mutate" {
-			admissionResponse = whsvr.mutate(&ar)
-		} else if r.URL.Path == "/validate" {
-			//admissionResponse = whsvr.validate(&ar)
-			glog.Errorf("Not set up to do validation")
+		glog.V(4).Infof("Admitting %s/%s on %s", ar.Request.Namespace, ar.Request.Name, path)
+		// the self test must exercise mutate on every probe
+		cacheable := ar.Request.UID != "" && ar.Request.UID != selfTestUID
+		cacheKey := responseCacheKey(path, ar.Request.UID)
+		cached, hit := whsvr.responseCache.get(cacheKey)
+		hit = hit && cacheable
+		if hit {
+			glog.Infof("Answering retried request %s for %s/%s from the cache", ar.Request.UID, ar.Request.Namespace, ar.Request.Name)
+			responseCacheHits.Inc()
+			admissionResponse = cached
+		} else if path == "/mutate" {
+			admissionResponse = whsvr.mutate(ctx, &ar)
+		} else if path == "/validate" {
+			admissionResponse = whsvr.validate(ctx, &ar)
+		}
+		// rejections may come from transient errors, a retry recomputes them
+		if !hit && cacheable && admissionResponse != nil && admissionResponse.Allowed {
+			whsvr.responseCache.put(cacheKey, admissionResponse)
 		}
 	}
 
-	admissionReview := v1beta1.AdmissionReview{}
+	// answer in the same admission.k8s.io version the request came in
+	admissionReview := v1beta1.AdmissionReview{TypeMeta: ar.TypeMeta}
+	if admissionReview.APIVersion == "" {
+		admissionReview.SetGroupVersionKind(v1beta1.SchemeGroupVersion.WithKind("AdmissionReview"))
+	}
+	if ar.Request != nil {
+		span.SetAttributes(
+			attribute.String("admission.kind", ar.Request.Kind.Kind),
+			attribute.String("admission.namespace", ar.Request.Namespace),
+			attribute.String("admission.name", ar.Request.Name),
+			attribute.String("admission.operation", string(ar.Request.Operation)),
+		)
+	}
 	if admissionResponse != nil {
+		span.SetAttributes(
+			attribute.Bool("admission.allowed", admissionResponse.Allowed),
+			attribute.Bool("admission.patched", len(admissionResponse.Patch) > 0),
+		)
 		admissionReview.Response = admissionResponse
 		if ar.Request != nil {
 			admissionReview.Response.UID = ar.Request.UID
 		}
+		whsvr.decisionSink.record(strings.TrimPrefix(path, "/"), ar.Request, admissionResponse)
 	}
-
-	resp, err := json.Marshal(admissionReview)
-	if err != nil {
-		glog.Errorf("Can't encode response: %v", err)
-		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
-	}
-	glog.Infof("Ready to write reponse ...")
-	if _, err := w.Write(resp); err != nil {
-		glog.Errorf("Can't write response: %v", err)
-		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
-	}
+	whsvr.dumper.dump(strings.TrimPrefix(path, "/"), ar.Request, body, &admissionReview)
+	return &admissionReview
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func FuzzHandleAdmission(f *testing.F) {
+	ingress, err := json.Marshal(ingressReview(f, testIngress("default", "web", map[string]string{"a": "b"})))
+	if err != nil {
+		f.Fatal(err)
+	}
+	pod, err := json.Marshal(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod"}})
+	if err != nil {
+		f.Fatal(err)
+	}
+	wrongKind, err := json.Marshal(&v1beta1.AdmissionReview{Request: &v1beta1.AdmissionRequest{
+		UID:       "pod-uid",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+		Namespace: "default",
+		Name:      "pod",
+		Operation: v1beta1.Create,
+		Object:    runtime.RawExtension{Raw: pod},
+	}})
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, seed := range [][]byte{
+		ingress,
+		ingress[:len(ingress)/2],
+		wrongKind,
+		[]byte(`{"kind":"AdmissionReview"}`),
+		[]byte(`{"kind":"AdmissionReview","request":{"uid":"u","operation":"CREATE","resource":{"resource":"ingresses"},"object":null}}`),
+		[]byte(`not json`),
+	} {
+		f.Add(seed)
+	}
+
+	whsvr := newTestServer(f, `[{"ingressName": "*", "defaultAnnotations": {"x": "1"}}]`)
+	f.Fuzz(func(t *testing.T, body []byte) {
+		// what handleAdmission gets out of the body when it decodes
+		var sent v1beta1.AdmissionReview
+		_, _, decodeErr := deserializer.Decode(body, nil, &sent)
+		for _, path := range []string{"/mutate", "/validate"} {
+			review := whsvr.handleAdmission(context.Background(), path, body)
+			if review == nil || review.Response == nil {
+				t.Fatalf("%s: no response", path)
+			}
+			if decodeErr == nil && sent.Request != nil && review.Response.UID != sent.Request.UID {
+				t.Fatalf("%s: response UID %q, want %q", path, review.Response.UID, sent.Request.UID)
+			}
+			if _, err := json.Marshal(review); err != nil {
+				t.Fatalf("%s: can't encode the review: %v", path, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,1037 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// newTestServer returns a server using the entries of config, which must be
+// free of problems
+func newTestServer(t testing.TB, config string) *WebhookServer {
+	t.Helper()
+	entries, errs := parseAnnotationConfig([]byte(config), "")
+	if len(errs) > 0 {
+		t.Fatalf("config has problems: %v", errs)
+	}
+	return &WebhookServer{
+		defaultAnnotations: entries,
+		annotationIndex:    newAnnotationIndex(entries),
+		configLoaded:       true,
+	}
+}
+
+// testIngress returns an ingress without spec
+func testIngress(namespace, name string, annotations map[string]string) *networkingv1beta1.Ingress {
+	return &networkingv1beta1.Ingress{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "networking.k8s.io/v1beta1", Kind: "Ingress"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Annotations: annotations},
+	}
+}
+
+// ingressReview returns the review of the CREATE of ingress
+func ingressReview(t testing.TB, ingress *networkingv1beta1.Ingress) *v1beta1.AdmissionReview {
+	t.Helper()
+	raw, err := json.Marshal(ingress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &v1beta1.AdmissionReview{Request: &v1beta1.AdmissionRequest{
+		UID:       "test-uid",
+		Kind:      metav1.GroupVersionKind{Group: "networking.k8s.io", Version: "v1beta1", Kind: "Ingress"},
+		Resource:  metav1.GroupVersionResource{Group: "networking.k8s.io", Version: "v1beta1", Resource: "ingresses"},
+		Namespace: ingress.Namespace,
+		Name:      ingress.Name,
+		Operation: v1beta1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}}
+}
+
+// updateReview returns the review of the UPDATE of old to ingress
+func updateReview(t testing.TB, old, ingress *networkingv1beta1.Ingress) *v1beta1.AdmissionReview {
+	t.Helper()
+	raw, err := json.Marshal(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar := ingressReview(t, ingress)
+	ar.Request.Operation = v1beta1.Update
+	ar.Request.OldObject = runtime.RawExtension{Raw: raw}
+	return ar
+}
+
+// patchedIngress returns ingress with patch applied
+func patchedIngress(t testing.TB, ingress *networkingv1beta1.Ingress, patch string) *networkingv1beta1.Ingress {
+	t.Helper()
+	raw, err := json.Marshal(ingress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops, err := jsonpatch.DecodePatch([]byte(patch))
+	if err != nil {
+		t.Fatalf("can't decode %s: %v", patch, err)
+	}
+	if raw, err = ops.Apply(raw); err != nil {
+		t.Fatalf("can't apply %s: %v", patch, err)
+	}
+	var patched networkingv1beta1.Ingress
+	if err := json.Unmarshal(raw, &patched); err != nil {
+		t.Fatal(err)
+	}
+	return &patched
+}
+
+// serveReview posts body to path of whsvr and returns the recorded answer
+func serveReview(whsvr *WebhookServer, path string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	whsvr.serve(w, req)
+	return w
+}
+
+// fakeIngressLister serves ingresses, or fails with err, and reports synced
+// unless unsynced is set. With block set List only returns once ctx is done.
+type fakeIngressLister struct {
+	ingresses []*networkingv1beta1.Ingress
+	err       error
+	unsynced  bool
+	block     bool
+}
+
+func (l *fakeIngressLister) List(ctx context.Context) ([]*networkingv1beta1.Ingress, error) {
+	if l.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return l.ingresses, l.err
+}
+
+func (l *fakeIngressLister) HasSynced() bool {
+	return !l.unsynced
+}
+
+// fakeNamespaceLister serves the labels of namespaces by name, or fails with
+// err
+type fakeNamespaceLister struct {
+	labels map[string]map[string]string
+	err    error
+}
+
+func (l *fakeNamespaceLister) Labels(ctx context.Context, name string) (map[string]string, error) {
+	return l.labels[name], l.err
+}
+
+func (l *fakeNamespaceLister) HasSynced() bool {
+	return true
+}
+
+// mutatePatch returns the patch mutate answers the review with, failing the
+// test when the request isn't allowed
+func mutatePatch(t testing.TB, whsvr *WebhookServer, ar *v1beta1.AdmissionReview) string {
+	t.Helper()
+	resp := whsvr.mutate(context.Background(), ar)
+	if !resp.Allowed {
+		t.Fatalf("mutation not allowed: %v", resp.Result)
+	}
+	return string(resp.Patch)
+}
+
+// mutatedAnnotations returns the annotations the ingress of ar ends up with
+func mutatedAnnotations(t testing.TB, whsvr *WebhookServer, ar *v1beta1.AdmissionReview) map[string]string {
+	t.Helper()
+	var ingress networkingv1beta1.Ingress
+	if err := json.Unmarshal(ar.Request.Object.Raw, &ingress); err != nil {
+		t.Fatal(err)
+	}
+	patch := mutatePatch(t, whsvr, ar)
+	if patch == "" {
+		return ingress.Annotations
+	}
+	return patchedIngress(t, &ingress, patch).Annotations
+}
+
+func TestMutateSkipsInvalidEntries(t *testing.T) {
+	entries, errs := parseAnnotationConfig([]byte(`[
+		{"ingressNameRegex": "prod-(", "defaultAnnotations": {"bad": "regex"}},
+		{"ingressName": "web", "defaultAnnotations": "a=b"},
+		{"ingressName": "*", "defaultAnnotations": {"good": "1"}}
+	]`), "")
+	if len(errs) != 2 || !entryErrorsOnly(errs) {
+		t.Fatalf("errors = %v, want one for each malformed entry", errs)
+	}
+	whsvr := &WebhookServer{defaultAnnotations: entries, annotationIndex: newAnnotationIndex(entries), configLoaded: true}
+	for _, name := range []string{"web", "anything"} {
+		patch := mutatePatch(t, whsvr, ingressReview(t, testIngress("default", name, nil)))
+		if want := `[{"op":"add","path":"/metadata/annotations","value":{"good":"1"}}]`; patch != want {
+			t.Errorf("patch for %s = %s, want %s", name, patch, want)
+		}
+	}
+}
+
+// BenchmarkMutate serves /mutate for one ingress of a config of 500 entries
+func BenchmarkMutate(b *testing.B) {
+	entries := make([]string, 0, 500)
+	for i := 0; i < 500; i++ {
+		entries = append(entries, fmt.Sprintf(`{"ingressName": "ing-%d", "defaultAnnotations": {"a": "b", "c": "d"}}`, i))
+	}
+	whsvr := newTestServer(b, "["+strings.Join(entries, ",")+"]")
+	ar := ingressReview(b, testIngress("default", "ing-250", nil))
+	ar.SetGroupVersionKind(v1beta1.SchemeGroupVersion.WithKind("AdmissionReview"))
+	body, err := json.Marshal(ar)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest("POST", "/mutate", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		whsvr.serve(w, req)
+		if i == 0 && !bytes.Contains(w.Body.Bytes(), []byte(`"patch"`)) {
+			b.Fatalf("no patch in %s", w.Body.String())
+		}
+	}
+}
+
+// BenchmarkMutateIgnoredNamespace compares a 50 rule ingress in an ignored
+// namespace, allowed before its object is decoded, with one that is mutated
+func BenchmarkMutateIgnoredNamespace(b *testing.B) {
+	whsvr := newTestServer(b, `[{"ingressName": "*", "defaultAnnotations": {"a": "b"}}]`)
+	whsvr.policy = policyConfig{NoMutateNamespaces: ignoredNamespaces}
+	for _, namespace := range []string{metav1.NamespaceSystem, metav1.NamespaceDefault} {
+		ingress := testIngress(namespace, "web", nil)
+		for i := 0; i < 50; i++ {
+			ingress.Spec.Rules = append(ingress.Spec.Rules, networkingv1beta1.IngressRule{Host: fmt.Sprintf("host-%d.example.com", i)})
+		}
+		ar := ingressReview(b, ingress)
+		b.Run(namespace, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				whsvr.mutate(context.Background(), ar)
+			}
+		})
+	}
+}
+
+func TestValidatePortConflicts(t *testing.T) {
+	onVIP := func(name, ip, port string) *networkingv1beta1.Ingress {
+		annotations := map[string]string{citrixInsecurePortAnnotation: port}
+		if ip != "" {
+			annotations[citrixFrontendIPAnnotation] = ip
+		}
+		return testIngress("default", name, annotations)
+	}
+	existing := &fakeIngressLister{ingresses: []*networkingv1beta1.Ingress{onVIP("first", "10.0.0.1", "80"), onVIP("shared", "", "80")}}
+	tests := []struct {
+		name    string
+		check   bool
+		lister  ingressLister
+		ingress *networkingv1beta1.Ingress
+		allowed bool
+	}{
+		{"off by default", false, existing, onVIP("second", "10.0.0.1", "80"), true},
+		{"same frontend ip and port", true, existing, onVIP("second", "10.0.0.1", "80"), false},
+		{"other port", true, existing, onVIP("second", "10.0.0.1", "8080"), true},
+		{"other frontend ip", true, existing, onVIP("second", "10.0.0.2", "80"), true},
+		{"no frontend ip", true, existing, onVIP("second", "", "80"), true},
+		{"update of itself", true, existing, onVIP("first", "10.0.0.1", "80"), true},
+		{"unsynced cache denies", true, &fakeIngressLister{unsynced: true}, onVIP("second", "10.0.0.1", "80"), false},
+		{"unsynced cache unused when off", false, &fakeIngressLister{unsynced: true}, onVIP("second", "10.0.0.1", "80"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			whsvr := newTestServer(t, `[]`)
+			whsvr.checkPortConflicts = tt.check
+			whsvr.ingressLister = tt.lister
+			resp := whsvr.validate(context.Background(), ingressReview(t, tt.ingress))
+			if resp.Allowed != tt.allowed {
+				t.Errorf("allowed = %v, want %v (%v)", resp.Allowed, tt.allowed, resp.Result)
+			}
+		})
+	}
+}
+
+func TestValidateKeepsWarnings(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(*WebhookServer)
+		allowed bool
+	}{
+		{"unsynced cache, fail open", func(w *WebhookServer) {
+			w.ingressLister = &fakeIngressLister{unsynced: true}
+			w.listerFailOpen = true
+		}, true},
+		{"unsynced cache, deny", func(w *WebhookServer) {
+			w.ingressLister = &fakeIngressLister{unsynced: true}
+		}, false},
+		{"list fails, fail open", func(w *WebhookServer) {
+			w.ingressLister = &fakeIngressLister{err: fmt.Errorf("timeout")}
+			w.listerFailOpen = true
+		}, true},
+		{"rejected", func(w *WebhookServer) {
+			w.policy.ForbiddenAnnotations = []string{"Example.com/a"}
+		}, false},
+		{"rejected in shadow mode", func(w *WebhookServer) {
+			w.policy.ForbiddenAnnotations = []string{"Example.com/a"}
+			w.validateShadow = true
+		}, true},
+	}
+	ingress := testIngress("default", "web", map[string]string{
+		citrixFrontendIPAnnotation: "10.0.0.1",
+		"Example.com/a":            "1",
+		"example.com/a":            "2",
+	})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			whsvr := newTestServer(t, `[]`)
+			whsvr.caseCollisions = caseCollisionsWarn
+			whsvr.checkPortConflicts = true
+			tt.setup(whsvr)
+			resp := whsvr.validate(context.Background(), ingressReview(t, ingress))
+			if resp.Allowed != tt.allowed {
+				t.Errorf("allowed = %v, want %v (%v)", resp.Allowed, tt.allowed, resp.Result)
+			}
+			if len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "differ only by case") {
+				t.Errorf("warnings = %q, want the case collision", resp.Warnings)
+			}
+		})
+	}
+}
+
+func TestMutateUpdateOfMutatedIngress(t *testing.T) {
+	whsvr := newTestServer(t, `[{"ingressName": "web", "defaultAnnotations": {"a": "1", "b": "2"}, "defaultLabels": {"team": "web"}}]`)
+	created := testIngress("default", "web", map[string]string{"user": "x"})
+	mutated := patchedIngress(t, created, mutatePatch(t, whsvr, ingressReview(t, created)))
+
+	// a no-op update, and one changing only what the webhook doesn't manage
+	changed := mutated.DeepCopy()
+	changed.Annotations["user"] = "y"
+	for _, ingress := range []*networkingv1beta1.Ingress{mutated, changed} {
+		if patch := mutatePatch(t, whsvr, updateReview(t, mutated, ingress)); patch != "" {
+			t.Errorf("update of %v got patch %s, want none", ingress.Annotations, patch)
+		}
+	}
+
+	// only the default the update took away comes back
+	removed := mutated.DeepCopy()
+	delete(removed.Annotations, "b")
+	want := `[{"op":"add","path":"/metadata/annotations/b","value":"2"}]`
+	if patch := mutatePatch(t, whsvr, updateReview(t, mutated, removed)); patch != want {
+		t.Errorf("patch = %s, want %s", patch, want)
+	}
+}
+
+func TestMutateIngressWithDefaultsAlreadySet(t *testing.T) {
+	var audit bytes.Buffer
+	whsvr := newTestServer(t, `[{"ingressName": "web", "defaultAnnotations": {"a": "1", "b": "2"}}]`)
+	whsvr.auditLog = &auditLogger{out: &audit}
+	ingress := testIngress("default", "web", map[string]string{"a": "1", "b": "2", "user": "x"})
+	resp := whsvr.mutate(context.Background(), ingressReview(t, ingress))
+	if !resp.Allowed || resp.Patch != nil || resp.PatchType != nil {
+		t.Errorf("response = %+v, want a plain allow", resp)
+	}
+	if audit.Len() > 0 {
+		t.Errorf("audit log got %q, want nothing", audit.String())
+	}
+
+	// a default with another value is still replaced
+	ingress.Annotations["b"] = "3"
+	want := `[{"op":"add","path":"/metadata/annotations/b","value":"2"}]`
+	if patch := mutatePatch(t, whsvr, ingressReview(t, ingress)); patch != want {
+		t.Errorf("patch = %s, want %s", patch, want)
+	}
+}
+
+func TestMutatePatchIsByteStable(t *testing.T) {
+	defaults := make([]string, 0, 20)
+	for i := 0; i < 20; i++ {
+		defaults = append(defaults, fmt.Sprintf(`"key-%02d": "%d"`, 20-i, i))
+	}
+	whsvr := newTestServer(t, `[
+		{"ingressName": "*", "defaultAnnotations": {`+strings.Join(defaults, ",")+`}, "defaultLabels": {"z": "1", "a": "2", "m": "3"}},
+		{"ingressName": "web", "defaultAnnotations": {"key-07": "web", "extra": "1"}}
+	]`)
+	for _, annotations := range []map[string]string{nil, {"user": "x", "key-03": "other"}} {
+		ar := ingressReview(t, testIngress("default", "web", annotations))
+		first := mutatePatch(t, whsvr, ar)
+		for i := 0; i < 50; i++ {
+			if patch := mutatePatch(t, whsvr, ar); patch != first {
+				t.Fatalf("patch changed between requests:\n%s\n%s", first, patch)
+			}
+		}
+	}
+}
+
+func TestMutateEntryPriority(t *testing.T) {
+	tests := []struct {
+		name       string
+		priorities [3]int
+		want       string
+	}{
+		{"ascending", [3]int{1, 2, 3}, "third"},
+		{"descending", [3]int{3, 2, 1}, "first"},
+		{"highest in the middle", [3]int{0, 10, -5}, "second"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// all catch-all entries, so only the priority orders them
+			whsvr := newTestServer(t, fmt.Sprintf(`[
+				{"ingressName": "*", "priority": %d, "defaultAnnotations": {"a": "first", "first": "1"}},
+				{"ingressName": "*", "priority": %d, "defaultAnnotations": {"a": "second", "second": "1"}},
+				{"ingressName": "*", "priority": %d, "defaultAnnotations": {"a": "third", "third": "1"}}
+			]`, tt.priorities[0], tt.priorities[1], tt.priorities[2]))
+			ingress := testIngress("default", "web", nil)
+			patched := patchedIngress(t, ingress, mutatePatch(t, whsvr, ingressReview(t, ingress)))
+			if got := patched.Annotations["a"]; got != tt.want {
+				t.Errorf("a = %q, want %q", got, tt.want)
+			}
+			for _, key := range []string{"first", "second", "third"} {
+				if patched.Annotations[key] != "1" {
+					t.Errorf("%s not set: %v", key, patched.Annotations)
+				}
+			}
+		})
+	}
+}
+
+func TestMutateJSONPatchEndState(t *testing.T) {
+	whsvr := newTestServer(t, `[{"ingressName": "web", "defaultAnnotations": {"ingress.citrix.com/frontend-ip": "10.0.0.1", "a~b": "1", "shared": "default"}}]`)
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        map[string]string
+	}{
+		{"no annotations", nil,
+			map[string]string{"ingress.citrix.com/frontend-ip": "10.0.0.1", "a~b": "1", "shared": "default"}},
+		{"others are kept", map[string]string{"user": "x"},
+			map[string]string{"ingress.citrix.com/frontend-ip": "10.0.0.1", "a~b": "1", "shared": "default", "user": "x"}},
+		{"defaults override", map[string]string{"shared": "user", "a~b": "2"},
+			map[string]string{"ingress.citrix.com/frontend-ip": "10.0.0.1", "a~b": "1", "shared": "default"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ingress := testIngress("default", "web", tt.annotations)
+			resp := whsvr.mutate(context.Background(), ingressReview(t, ingress))
+			if resp.PatchType == nil || *resp.PatchType != v1beta1.PatchTypeJSONPatch {
+				t.Fatalf("patch type = %v, want JSONPatch", resp.PatchType)
+			}
+			if got := patchedIngress(t, ingress, string(resp.Patch)).Annotations; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("annotations = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestReloadConfigWhileMutating is meant for -race: requests are served while
+// the config is swapped, as on SIGHUP
+func TestReloadConfigWhileMutating(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configs := []string{
+		`[{"ingressName": "web", "defaultAnnotations": {"version": "1"}}]`,
+		`[{"ingressName": "web", "defaultAnnotations": {"version": "2"}}]`,
+	}
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(configs[0]), 0600); err != nil {
+		t.Fatal(err)
+	}
+	whsvr := &WebhookServer{annotationCfgFile: path}
+	if err := whsvr.reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	ar := ingressReview(t, testIngress("default", "web", nil))
+
+	stop := make(chan struct{})
+	var reloads sync.WaitGroup
+	reloads.Add(1)
+	go func() {
+		defer reloads.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			// written aside and renamed, as a ConfigMap update is
+			tmp := path + ".tmp"
+			if err := ioutil.WriteFile(tmp, []byte(configs[i%2]), 0600); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := os.Rename(tmp, path); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := whsvr.reloadConfig(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	var requests sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			for i := 0; i < 200; i++ {
+				resp := whsvr.mutate(context.Background(), ar)
+				patch := string(resp.Patch)
+				if !resp.Allowed || (!strings.Contains(patch, `"value":{"version":"1"}`) && !strings.Contains(patch, `"value":{"version":"2"}`)) {
+					t.Errorf("response = %+v, want the defaults of one of the configs", resp)
+					return
+				}
+			}
+		}()
+	}
+	requests.Wait()
+	close(stop)
+	reloads.Wait()
+}
+
+// TestReloadConfigDropsInvalidEntries checks that a reload treats an entry
+// with a problem as startup does, leaving it out and using the others
+func TestReloadConfigDropsInvalidEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	write := func(config string) {
+		if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`[{"ingressName": "web", "defaultAnnotations": {"version": "1"}}]`)
+	whsvr := &WebhookServer{annotationCfgFile: path}
+	if err := whsvr.reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	write(`[{"ingressName": "web", "defaultAnnotations": {"version": "2"}},
+		{"ingressName": "api", "defaultAnnotations": "version=2"}]`)
+	if err := whsvr.reloadConfig(); err != nil {
+		t.Fatalf("reload with one invalid entry: %v", err)
+	}
+	entries := whsvr.annotationConfig()
+	if len(entries) != 1 || entries[0].IngressName != "web" || entries[0].DefaultAnnotations.toMap()["version"] != "2" {
+		t.Errorf("entries = %+v, want only the valid entry of the new file", entries)
+	}
+
+	write(`[{"ingressName": "web", "defaultAnnotations": {"version": "3"}}`)
+	if err := whsvr.reloadConfig(); err == nil {
+		t.Error("reload of a file that doesn't parse succeeded")
+	}
+	if entries := whsvr.annotationConfig(); len(entries) != 1 || entries[0].DefaultAnnotations.toMap()["version"] != "2" {
+		t.Errorf("entries = %+v, want the previous configuration kept", entries)
+	}
+}
+
+func TestServeResponseTypeMeta(t *testing.T) {
+	whsvr := newTestServer(t, `[{"ingressName": "*", "defaultAnnotations": {"a": "1"}}]`)
+	tests := []struct {
+		name       string
+		apiVersion string
+		want       string
+	}{
+		{"v1beta1", "admission.k8s.io/v1beta1", "admission.k8s.io/v1beta1"},
+		{"v1", "admission.k8s.io/v1", "admission.k8s.io/v1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ar := ingressReview(t, testIngress("default", "web", nil))
+			ar.APIVersion, ar.Kind = tt.apiVersion, "AdmissionReview"
+			body, err := json.Marshal(ar)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, path := range []string{"/mutate", "/validate"} {
+				w := serveReview(whsvr, path, body)
+				if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+					t.Errorf("%s: Content-Type = %q, want application/json", path, ct)
+				}
+				var typeMeta metav1.TypeMeta
+				if err := json.Unmarshal(w.Body.Bytes(), &typeMeta); err != nil {
+					t.Fatalf("%s: %v in %s", path, err, w.Body.String())
+				}
+				if typeMeta.APIVersion != tt.want || typeMeta.Kind != "AdmissionReview" {
+					t.Errorf("%s: answered as %s %s, want %s AdmissionReview", path, typeMeta.APIVersion, typeMeta.Kind, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMutateNamespaceOverrides(t *testing.T) {
+	whsvr := newTestServer(t, `[
+		{"ingressName": "web", "namespace": "team-a", "defaultAnnotations": {"timeout": "60", "team": "a"}},
+		{"ingressName": "web", "defaultAnnotations": {"timeout": "30", "class": "citrix"}}
+	]`)
+	tests := []struct {
+		namespace string
+		want      map[string]string
+	}{
+		{"team-a", map[string]string{"timeout": "60", "team": "a", "class": "citrix"}},
+		{"team-b", map[string]string{"timeout": "30", "class": "citrix"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.namespace, func(t *testing.T) {
+			ingress := testIngress(tt.namespace, "web", nil)
+			patched := patchedIngress(t, ingress, mutatePatch(t, whsvr, ingressReview(t, ingress)))
+			if !reflect.DeepEqual(patched.Annotations, tt.want) {
+				t.Errorf("annotations = %v, want %v", patched.Annotations, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdmissionReviewWithoutRequest(t *testing.T) {
+	whsvr := newTestServer(t, `[{"ingressName": "*", "defaultAnnotations": {"a": "1"}}]`)
+	for _, path := range []string{"/mutate", "/validate"} {
+		w := serveReview(whsvr, path, []byte(`{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview"}`))
+		if w.Code != 200 {
+			t.Errorf("%s: status %d, want 200", path, w.Code)
+		}
+		var review v1beta1.AdmissionReview
+		if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil {
+			t.Fatalf("%s: %v in %s", path, err, w.Body.String())
+		}
+		if review.Response == nil || review.Response.Allowed || review.Response.Result == nil || review.Response.Result.Message != "admission request is nil" {
+			t.Errorf("%s: response = %+v, want an error", path, review.Response)
+		}
+	}
+	// mutate and validate check for themselves too
+	if resp := whsvr.mutate(context.Background(), &v1beta1.AdmissionReview{}); resp.Allowed || resp.Result == nil {
+		t.Errorf("mutate answered %+v, want an error", resp)
+	}
+	if resp := whsvr.validate(context.Background(), &v1beta1.AdmissionReview{}); resp.Allowed || resp.Result == nil {
+		t.Errorf("validate answered %+v, want an error", resp)
+	}
+}
+
+func TestMutateAuditAnnotation(t *testing.T) {
+	whsvr := newTestServer(t, `[
+		{"ingressName": "web", "namespace": "staging", "defaultAnnotations": {"b": "2"}},
+		{"ingressName": "*", "defaultAnnotations": {"a": "1"}}
+	]`)
+	tests := []struct {
+		name    string
+		ingress *networkingv1beta1.Ingress
+		want    map[string]string
+	}{
+		{"one entry", testIngress("prod", "web", nil), map[string]string{auditAnnotationAppliedEntry: "*"}},
+		{"entries in merge order", testIngress("staging", "web", nil), map[string]string{auditAnnotationAppliedEntry: "*,staging/web"}},
+		{"nothing to change", testIngress("prod", "web", map[string]string{"a": "1"}), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := whsvr.mutate(context.Background(), ingressReview(t, tt.ingress))
+			if !reflect.DeepEqual(resp.AuditAnnotations, tt.want) {
+				t.Errorf("audit annotations = %v, want %v", resp.AuditAnnotations, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateListerFailurePolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		lister   *fakeIngressLister
+		failOpen bool
+		allowed  bool
+		message  string
+	}{
+		{"unsynced, deny", &fakeIngressLister{unsynced: true}, false, false, "ingress cache not synced"},
+		{"unsynced, allow", &fakeIngressLister{unsynced: true}, true, true, ""},
+		{"list times out, deny", &fakeIngressLister{block: true}, false, false, "could not list ingresses: context deadline exceeded"},
+		{"list times out, allow", &fakeIngressLister{block: true}, true, true, ""},
+		{"synced", &fakeIngressLister{}, false, true, ""},
+	}
+	ingress := testIngress("default", "web", map[string]string{citrixFrontendIPAnnotation: "10.0.0.1"})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			whsvr := newTestServer(t, `[]`)
+			whsvr.checkPortConflicts = true
+			whsvr.ingressLister = tt.lister
+			whsvr.listerTimeout = 10 * time.Millisecond
+			whsvr.listerFailOpen = tt.failOpen
+			resp := whsvr.validate(context.Background(), ingressReview(t, ingress))
+			if resp.Allowed != tt.allowed {
+				t.Errorf("allowed = %v, want %v (%v)", resp.Allowed, tt.allowed, resp.Result)
+			}
+			if tt.message != "" && (resp.Result == nil || resp.Result.Message != tt.message) {
+				t.Errorf("result = %v, want %q", resp.Result, tt.message)
+			}
+		})
+	}
+}
+
+func TestAdmitUnexpectedKind(t *testing.T) {
+	whsvr := newTestServer(t, `[{"ingressName": "*", "defaultAnnotations": {"a": "1"}}]`)
+	pod, err := json.Marshal(&corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar := &v1beta1.AdmissionReview{Request: &v1beta1.AdmissionRequest{
+		UID:       "pod-uid",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+		Namespace: "default",
+		Name:      "web",
+		Operation: v1beta1.Create,
+		Object:    runtime.RawExtension{Raw: pod},
+	}}
+	if resp := whsvr.mutate(context.Background(), ar); !resp.Allowed || resp.Patch != nil {
+		t.Errorf("mutate answered %+v, want a plain allow", resp)
+	}
+	if resp := whsvr.validate(context.Background(), ar); !resp.Allowed {
+		t.Errorf("validate answered %+v, want an allow", resp)
+	}
+}
+
+func TestMutateOptOut(t *testing.T) {
+	whsvr := newTestServer(t, `[{"ingressName": "web", "defaultAnnotations": {"a": "1"}}]`)
+	tests := []struct {
+		value   string
+		patched bool
+	}{
+		{"false", false},
+		{"False", false},
+		{"true", true},
+		{"", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			ingress := testIngress("default", "web", map[string]string{admissionWebhookAnnotationMutateKey: tt.value})
+			if patch := mutatePatch(t, whsvr, ingressReview(t, ingress)); (patch != "") != tt.patched {
+				t.Errorf("patch = %q, want patched %v", patch, tt.patched)
+			}
+		})
+	}
+}
+
+func TestServeGzipBody(t *testing.T) {
+	whsvr := newTestServer(t, `[{"ingressName": "*", "defaultAnnotations": {"a": "1"}}]`)
+	body, err := json.Marshal(ingressReview(t, testIngress("default", "web", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(body)
+	gz.Close()
+	tests := []struct {
+		name string
+		body []byte
+		code int
+	}{
+		{"gzipped review", gzipped.Bytes(), 200},
+		{"not gzip", body, 400},
+		{"truncated", gzipped.Bytes()[:gzipped.Len()/2], 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/mutate", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Content-Encoding", "gzip")
+			w := httptest.NewRecorder()
+			whsvr.serve(w, req)
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.code, w.Body.String())
+			}
+			if tt.code == 200 && !bytes.Contains(w.Body.Bytes(), []byte(`"patch"`)) {
+				t.Errorf("no patch in %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestMutateOrderedAnnotations(t *testing.T) {
+	whsvr := newTestServer(t, `[{"ingressName": "web", "defaultAnnotations": [{"key": "z", "value": "1"}, {"key": "a", "value": "2"}]}]`)
+	ingress := testIngress("default", "web", map[string]string{"user": "x"})
+	want := `[{"op":"add","path":"/metadata/annotations/z","value":"1"},{"op":"add","path":"/metadata/annotations/a","value":"2"}]`
+	if patch := mutatePatch(t, whsvr, ingressReview(t, ingress)); patch != want {
+		t.Errorf("patch = %s, want %s", patch, want)
+	}
+}
+
+func TestMutateCatchAll(t *testing.T) {
+	// the catch-all comes last in the file but is still merged first
+	whsvr := newTestServer(t, `[
+		{"ingressName": "web", "defaultAnnotations": {"timeout": "60", "web": "1"}},
+		{"ingressName": "*", "defaultAnnotations": {"monitoring": "on", "timeout": "30"}}
+	]`)
+	whsvr.policy = policyConfig{NoMutateNamespaces: ignoredNamespaces}
+	tests := []struct {
+		name    string
+		ingress *networkingv1beta1.Ingress
+		want    map[string]string
+	}{
+		{"named entry overrides", testIngress("default", "web", nil), map[string]string{"monitoring": "on", "timeout": "60", "web": "1"}},
+		{"catch-all alone", testIngress("default", "api", nil), map[string]string{"monitoring": "on", "timeout": "30"}},
+		{"ignored namespace", testIngress(metav1.NamespaceSystem, "api", nil), nil},
+		{"opted out", testIngress("default", "api", map[string]string{admissionWebhookAnnotationMutateKey: "false"}),
+			map[string]string{admissionWebhookAnnotationMutateKey: "false"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mutatedAnnotations(t, whsvr, ingressReview(t, tt.ingress)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("annotations = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMutateAnnotationSizeLimit(t *testing.T) {
+	whsvr := newTestServer(t, `[{"ingressName": "web", "defaultAnnotations": {"a": "12345"}}]`)
+	// "big" and its value make up the rest of the limit after "a": "12345"
+	fill := maxAnnotationsSize - len("a12345") - len("big")
+	tests := []struct {
+		name    string
+		size    int
+		allowed bool
+	}{
+		{"at the limit", fill, true},
+		{"one byte over", fill + 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ingress := testIngress("default", "web", map[string]string{"big": strings.Repeat("x", tt.size)})
+			resp := whsvr.mutate(context.Background(), ingressReview(t, ingress))
+			if resp.Allowed != tt.allowed {
+				t.Fatalf("allowed = %v, want %v (%v)", resp.Allowed, tt.allowed, resp.Result)
+			}
+			if want := fmt.Sprintf("annotations of default/web would be %d bytes", maxAnnotationsSize+1); !tt.allowed && !strings.Contains(resp.Result.Message, want) {
+				t.Errorf("message %q doesn't say %q", resp.Result.Message, want)
+			}
+		})
+	}
+}
+
+func TestValidateReportsAllFailures(t *testing.T) {
+	whsvr := newTestServer(t, `[]`)
+	whsvr.policy = policyConfig{
+		ForbiddenAnnotations: []string{"example.com/forbidden"},
+		RequiredAnnotations:  []requiredAnnotation{{Key: "example.com/owner"}},
+	}
+	whsvr.requireBackend = true
+	ingress := testIngress("default", "web", map[string]string{"example.com/forbidden": "1"})
+	resp := whsvr.validate(context.Background(), ingressReview(t, ingress))
+	if resp.Allowed {
+		t.Fatal("ingress allowed")
+	}
+	want := []string{
+		"annotations example.com/forbidden are forbidden",
+		"annotation example.com/owner is required",
+		"ingress has neither spec.defaultBackend nor spec.rules",
+	}
+	if resp.Result.Details == nil || len(resp.Result.Details.Causes) != len(want) {
+		t.Fatalf("result = %+v, want %d causes", resp.Result, len(want))
+	}
+	for i, w := range want {
+		if cause := resp.Result.Details.Causes[i]; !strings.HasPrefix(cause.Message, w) || cause.Type != metav1.CauseTypeFieldValueInvalid {
+			t.Errorf("cause %d = %+v, want %q", i, cause, w)
+		}
+		if !strings.Contains(resp.Result.Message, w) {
+			t.Errorf("message %q doesn't contain %q", resp.Result.Message, w)
+		}
+	}
+}
+
+func TestValidateLockdown(t *testing.T) {
+	whsvr := newTestServer(t, `[]`)
+	whsvr.policy = policyConfig{Lockdown: true, LockdownAllowedUsers: []string{"system:serviceaccount:ops:deployer"}}
+	tests := []struct {
+		name      string
+		user      string
+		operation v1beta1.Operation
+		allowed   bool
+	}{
+		{"create", "alice", v1beta1.Create, false},
+		{"update", "alice", v1beta1.Update, false},
+		{"delete", "alice", v1beta1.Delete, true},
+		{"allowed service account", "system:serviceaccount:ops:deployer", v1beta1.Create, true},
+		{"other service account", "system:serviceaccount:ops:other", v1beta1.Update, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ar := ingressReview(t, testIngress("default", "web", nil))
+			ar.Request.Operation = tt.operation
+			ar.Request.UserInfo.Username = tt.user
+			resp := whsvr.validate(context.Background(), ar)
+			if resp.Allowed != tt.allowed {
+				t.Fatalf("allowed = %v, want %v (%v)", resp.Allowed, tt.allowed, resp.Result)
+			}
+			if !tt.allowed && !strings.Contains(resp.Result.Message, "locked down") {
+				t.Errorf("message %q doesn't mention the lockdown", resp.Result.Message)
+			}
+		})
+	}
+}
+
+func TestServeReviewWithoutObject(t *testing.T) {
+	whsvr := newTestServer(t, `[{"ingressName": "*", "defaultAnnotations": {"a": "1"}}]`)
+	tests := []struct {
+		name      string
+		operation v1beta1.Operation
+		object    []byte
+		rejected  bool
+	}{
+		{"create without object", v1beta1.Create, nil, true},
+		{"update with null object", v1beta1.Update, []byte("null"), true},
+		{"delete without object", v1beta1.Delete, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ar := ingressReview(t, testIngress("default", "web", nil))
+			ar.APIVersion, ar.Kind = "admission.k8s.io/v1", "AdmissionReview"
+			ar.Request.Operation = tt.operation
+			ar.Request.Object.Raw = tt.object
+			body, err := json.Marshal(ar)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, path := range []string{"/mutate", "/validate"} {
+				var review v1beta1.AdmissionReview
+				if err := json.Unmarshal(serveReview(whsvr, path, body).Body.Bytes(), &review); err != nil {
+					t.Fatal(err)
+				}
+				if review.APIVersion != "admission.k8s.io/v1" || review.Response == nil || review.Response.UID != "test-uid" {
+					t.Fatalf("%s: answered %+v, want the version and UID of the request", path, review)
+				}
+				rejected := review.Response.Result != nil && strings.Contains(review.Response.Result.Message, "has no object")
+				if rejected != tt.rejected || (rejected && review.Response.Allowed) {
+					t.Errorf("%s: response = %+v, want rejected %v", path, review.Response, tt.rejected)
+				}
+			}
+		})
+	}
+}
+
+func TestWatchNamespace(t *testing.T) {
+	whsvr := newTestServer(t, `[{"ingressName": "*", "defaultAnnotations": {"a": "1"}}]`)
+	whsvr.watchNamespace = "team-a"
+	// would reject every ingress it looked at
+	whsvr.policy = policyConfig{RequiredAnnotations: []requiredAnnotation{{Key: "example.com/owner"}}}
+	tests := []struct {
+		namespace string
+		admitted  bool
+	}{
+		{"team-a", true},
+		{"team-b", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.namespace, func(t *testing.T) {
+			body, err := json.Marshal(ingressReview(t, testIngress(tt.namespace, "web", nil)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			mutated := whsvr.handleAdmission(context.Background(), "/mutate", body).Response
+			validated := whsvr.handleAdmission(context.Background(), "/validate", body).Response
+			if admitted := mutated.Patch != nil; admitted != tt.admitted {
+				t.Errorf("mutation patched %v, want %v", admitted, tt.admitted)
+			}
+			if admitted := !validated.Allowed; admitted != tt.admitted {
+				t.Errorf("validation rejected %v, want %v", admitted, tt.admitted)
+			}
+			if !tt.admitted && (!mutated.Allowed || mutated.Result != nil || validated.Result != nil) {
+				t.Errorf("responses %+v and %+v, want plain allows", mutated, validated)
+			}
+		})
+	}
+}
+
+func TestMutateNamespaceLabels(t *testing.T) {
+	lister := &fakeNamespaceLister{labels: map[string]map[string]string{
+		"team-a": {"team": "a", "cost-center": "1234", "tier": "gold"},
+		"team-b": {"team": "b"},
+	}}
+	const config = `[
+		{"ingressName": "*", "defaultAnnotations": {"example.com/owner": "team-${NAMESPACE_LABEL:team}", "example.com/billing": "${NAMESPACE_LABEL:team}/${NAMESPACE_LABEL:cost-center}", "static": "1"}},
+		{"ingressName": "*", "namespaceSelector": {"matchLabels": {"tier": "gold"}}, "defaultAnnotations": {"example.com/sla": "gold"}}
+	]`
+	tests := []struct {
+		name      string
+		lister    namespaceLister
+		namespace string
+		want      map[string]string
+	}{
+		{"all labels", lister, "team-a",
+			map[string]string{"example.com/owner": "team-a", "example.com/billing": "a/1234", "static": "1", "example.com/sla": "gold"}},
+		{"missing label drops the annotation", lister, "team-b",
+			map[string]string{"example.com/owner": "team-b", "static": "1"}},
+		{"unknown namespace", lister, "team-c", map[string]string{"static": "1"}},
+		{"lister fails", &fakeNamespaceLister{err: fmt.Errorf("timeout")}, "team-a", map[string]string{"static": "1"}},
+		{"no lister", nil, "team-a", map[string]string{"static": "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			whsvr := newTestServer(t, config)
+			whsvr.namespaceLister = tt.lister
+			if got := mutatedAnnotations(t, whsvr, ingressReview(t, testIngress(tt.namespace, "web", nil))); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("annotations = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMutateDefaultLabels(t *testing.T) {
+	whsvr := newTestServer(t, `[{"ingressName": "web", "defaultLabels": {"app.kubernetes.io/managed-by": "citrix-webhook", "tier": "web"}}]`)
+	tests := []struct {
+		name   string
+		labels map[string]string
+		patch  string
+	}{
+		{"no labels", nil,
+			`[{"op":"add","path":"/metadata/labels","value":{"app.kubernetes.io/managed-by":"citrix-webhook","tier":"web"}}]`},
+		{"other labels", map[string]string{"app": "shop"},
+			`[{"op":"add","path":"/metadata/labels/app.kubernetes.io~1managed-by","value":"citrix-webhook"},{"op":"add","path":"/metadata/labels/tier","value":"web"}]`},
+		{"one already set", map[string]string{"tier": "web"},
+			`[{"op":"add","path":"/metadata/labels/app.kubernetes.io~1managed-by","value":"citrix-webhook"}]`},
+		{"all set", map[string]string{"tier": "web", "app.kubernetes.io/managed-by": "citrix-webhook"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ingress := testIngress("default", "web", nil)
+			ingress.Labels = tt.labels
+			patch := mutatePatch(t, whsvr, ingressReview(t, ingress))
+			if patch != tt.patch {
+				t.Fatalf("patch = %s, want %s", patch, tt.patch)
+			}
+			if patch == "" {
+				return
+			}
+			labels := patchedIngress(t, ingress, patch).Labels
+			if labels["tier"] != "web" || labels["app.kubernetes.io/managed-by"] != "citrix-webhook" || (tt.labels["app"] != "" && labels["app"] != "shop") {
+				t.Errorf("labels = %v", labels)
+			}
+		})
+	}
+}